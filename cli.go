@@ -0,0 +1,512 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"goreplace/modreplace"
+)
+
+// cli holds the command-line settings. Each subcommand registers only the
+// flags that make sense for it.
+type cli struct {
+	command       string
+	goModPath     string
+	goWork        string
+	configPath    string
+	configExt     string
+	mergeStrategy string
+	template      string
+	strict        bool
+	strictTargets bool
+	quiet         bool
+	summaryOnly   bool
+	replaceBase   string
+	clean         bool
+	check         bool
+	fix           bool
+	list          bool
+	dryRun        bool
+	diff          bool
+	diffContext   int
+	tidySum       bool
+	backup        bool
+	noRename      bool
+	goModRef      string
+	tempDir       string
+	keepTemp      bool
+	expectChanges bool
+	forceWrite    bool
+	trace         bool
+	format        string
+	emit          string
+	only          stringsFlag
+	timeout       time.Duration
+	formatFile    bool
+	maxMatches    int
+	timings       bool
+	dryRunOut     string
+	requireClean  bool
+	gitAdd        bool
+	verifyList    bool
+	allowExec     bool
+	noValidate    bool
+	lockOut       string
+	concurrency   int
+	dryRunZero    bool
+	verifyGraph   bool
+	replaceFlags  stringsFlag
+	rules         []modreplace.FindReplace
+	ensureGo      string
+	output        string
+	dedupe        bool
+	unmatched     bool
+	abortOnParse  bool
+	allowModules  stringsFlag
+	fromLock      string
+	diffReplaces  bool
+	relative      bool
+	relativeTo    string
+	noProvenance  bool
+	retainOrder   bool
+	noClean       bool
+	printModule   bool
+	confirmEach   bool
+	transactional bool
+	explain       bool
+	warnUnused    bool
+	header        string
+	footer        string
+	// goModSet is true when -gomod was given, on the command line or in the
+	// environment
+	goModSet bool
+	validate bool
+	// migrate writes a go.work at workOut from the go.mods in goModPaths
+	migrate        bool
+	workOut        string
+	goModPaths     []string
+	removeReplaces bool
+	failOnWarnings bool
+	// warned is set once any warning has been reported
+	warned bool
+	// shell is the shell to print a completion script for
+	shell string
+	// selftest runs the built-in fixture instead of processing go.mod
+	selftest bool
+	// diffConfig compares the go.mod oldConfig and newConfig would produce
+	diffConfig bool
+	oldConfig  string
+	newConfig  string
+}
+
+// stringsFlag is a flag that may be given more than once, collecting every
+// value.
+type stringsFlag struct {
+	values []string
+	// fromEnv is set while values holds the one from the environment, which
+	// the first value given on the command line replaces
+	fromEnv bool
+}
+
+func (s *stringsFlag) String() string {
+	return strings.Join(s.values, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	if s.fromEnv {
+		s.values, s.fromEnv = nil, false
+	}
+	s.values = append(s.values, value)
+	return nil
+}
+
+// commands are the subcommands goreplace accepts, in usage order.
+var commands = []struct{ name, desc string }{
+	{"apply", "Replace matching modules according to the config"},
+	{"clean", "Remove all replace directives"},
+	{"check", "Exit with an error if go.mod is not up to date, without writing it"},
+	{"list", "Print the replace directives in go.mod and whether the config manages them"},
+	{"validate-config", "Check a config for problems without a go.mod"},
+	{"diff-config", "Show how go.mod would differ between two configs, without writing it"},
+	{"migrate-to-workspace", "Write a go.work using the modules that local replaces point at"},
+	{"completion", "Print a completion script for bash, zsh or fish"},
+	{"selftest", "Check that this binary works by running it against a built-in fixture"},
+}
+
+// positionalArgs are the arguments each command accepts after its flags, in
+// order, as alternatives to the -gomod and -config flags.
+var positionalArgs = map[string][]string{
+	"apply": {"go.mod", "config"},
+	"check": {"go.mod", "config"},
+	"list":  {"go.mod", "config"},
+	"clean": {"go.mod"},
+}
+
+// parseArgs parses the subcommand and flags in args. Without a subcommand the
+// flags from before subcommands existed are accepted, with -clean, -check and
+// -list kept as deprecated aliases.
+func parseArgs(args []string) (*cli, error) {
+	c := &cli{}
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		c.command, args = args[0], args[1:]
+	}
+
+	fs, err := c.flagSet()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = setFlagsFromEnv(fs); err != nil {
+		return nil, err
+	}
+	if err = fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if c.migrate {
+		c.goModPaths = fs.Args()
+		if len(c.goModPaths) == 0 {
+			c.goModPaths = []string{c.goModPath}
+		}
+	}
+	if c.command == "completion" {
+		c.shell = fs.Arg(0)
+		if !slices.Contains(completionShells, c.shell) {
+			return nil, fmt.Errorf("goreplace completion needs a shell: one of %s", strings.Join(completionShells, ", "))
+		}
+	}
+
+	// Arguments override the flags they stand for
+	if positional, ok := positionalArgs[c.command]; ok {
+		if fs.NArg() > len(positional) {
+			return nil, fmt.Errorf("too many arguments; usage: goreplace %s [flags] [%s%s",
+				c.command, strings.Join(positional, " ["), strings.Repeat("]", len(positional)))
+		}
+		for i, arg := range fs.Args() {
+			switch positional[i] {
+			case "go.mod":
+				c.goModPath, c.goModSet = arg, true
+			case "config":
+				c.configPath = arg
+			}
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "gomod":
+			c.goModSet = true
+		case "clean", "check", "list":
+			if c.command == "" {
+				c.warn(fmt.Sprintf("-%s is deprecated; use goreplace %s", f.Name, f.Name))
+			}
+		}
+	})
+
+	if c.format != "" && c.format != "text" && c.format != "json" {
+		return nil, fmt.Errorf("unknown format %q: want text or json", c.format)
+	}
+	if c.configExt != "" && !slices.Contains(modreplace.ConfigExts, c.configExt) {
+		return nil, fmt.Errorf("unknown config format %q: want one of %s", c.configExt, strings.Join(modreplace.ConfigExts, ", "))
+	}
+	if c.mergeStrategy != "" && !slices.Contains(modreplace.MergeStrategies, c.mergeStrategy) {
+		return nil, fmt.Errorf("unknown -config-merge-strategy %q: want one of %s", c.mergeStrategy, strings.Join(modreplace.MergeStrategies, ", "))
+	}
+	if c.emit != "" && c.emit != "overlay" && c.emit != "commands" && c.emit != "patch" {
+		return nil, fmt.Errorf("unknown -emit %q: want overlay, commands or patch", c.emit)
+	}
+	if c.ensureGo != "" && !modfile.GoVersionRE.MatchString(c.ensureGo) {
+		return nil, fmt.Errorf("bad -ensure-go-version %q: want a go version such as 1.21", c.ensureGo)
+	}
+	for _, entry := range c.replaceFlags.values {
+		rule, err := modreplace.ParseRule(entry, "command line")
+		if err != nil {
+			return nil, fmt.Errorf("bad -replace: %w", err)
+		}
+		c.rules = append(c.rules, rule)
+	}
+	for _, pattern := range c.only.values {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad -only pattern %q: %w", pattern, err)
+		}
+	}
+	if c.confirmEach && c.configPath == "-" {
+		return nil, fmt.Errorf("-confirm-each can't read answers when the config comes from stdin")
+	}
+	if c.noClean && c.clean {
+		return nil, fmt.Errorf("-no-clean can't be used with -clean")
+	}
+	if c.maxMatches < 0 {
+		return nil, fmt.Errorf("-max-matches must not be negative")
+	}
+	if c.diffContext < 0 {
+		return nil, fmt.Errorf("-diff-context must not be negative")
+	}
+	if c.diffConfig && (c.oldConfig == "" || c.newConfig == "") {
+		return nil, fmt.Errorf("diff-config needs both -old and -new")
+	}
+	if c.goModRef != "" {
+		_, path, ok := strings.Cut(c.goModRef, ":")
+		if !ok || path == "" || strings.HasPrefix(c.goModRef, ":") {
+			return nil, fmt.Errorf("-gomod-ref %q must be REF:PATH, such as main:go.mod", c.goModRef)
+		}
+		if c.goWork != "" {
+			return nil, fmt.Errorf("-gomod-ref can't be used with -gowork")
+		}
+		readOnly := c.list || c.emit != "" || c.dryRun || c.diff || c.diffReplaces || (c.check && !c.fix)
+		if !readOnly {
+			return nil, fmt.Errorf("-gomod-ref never writes go.mod; use it with check, list, -diff or -dry-run")
+		}
+		c.goModPath, c.goModSet = path, true
+	}
+	if c.dryRunOut != "" && !c.dryRun {
+		return nil, fmt.Errorf("-dry-run-out requires -dry-run")
+	}
+	if c.dryRunOut != "" && c.goWork != "" {
+		return nil, fmt.Errorf("-dry-run-out can't be used with -gowork")
+	}
+	// Each preview prints go.mod its own way, so only one can be asked for
+	var previews []string
+	for _, preview := range []struct {
+		name string
+		set  bool
+	}{{"-dry-run", c.dryRun}, {"-diff", c.diff}, {"-diff-only-replaces", c.diffReplaces}} {
+		if preview.set {
+			previews = append(previews, preview.name)
+		}
+	}
+	if len(previews) > 1 {
+		return nil, fmt.Errorf("%s can't be used together; pick one", strings.Join(previews, " and "))
+	}
+	if c.output != "" && c.emit == "" {
+		return nil, fmt.Errorf("-output requires -emit")
+	}
+
+	return c, nil
+}
+
+// flagSet returns the flags of c.command, bound to c. Completion scripts use
+// it to list each command's flags.
+func (c *cli) flagSet() (*flag.FlagSet, error) {
+	fs := flag.NewFlagSet(strings.TrimSpace("goreplace "+c.command), flag.ExitOnError)
+	switch c.command {
+	case "":
+		c.goModFlags(fs)
+		c.configFlags(fs)
+		c.outputFlags(fs)
+		c.writeFlags(fs)
+		fs.BoolVar(&c.tidySum, "tidy-sum", false, "Drop go.sum lines for modules that are replaced with a local directory")
+		fs.StringVar(&c.format, "format", "text", "Output format for -list and -print-module: text or json")
+		c.emitFlags(fs)
+		c.onlyFlag(fs)
+		fs.BoolVar(&c.confirmEach, "confirm-each", false, "Ask before adding each replace; needs a terminal")
+		fs.BoolVar(&c.clean, "clean", false, "Deprecated: use goreplace clean")
+		fs.BoolVar(&c.check, "check", false, "Deprecated: use goreplace check")
+		fs.BoolVar(&c.fix, "fix", false, "With -check, apply the changes when go.mod is out of date")
+		fs.BoolVar(&c.list, "list", false, "Deprecated: use goreplace list")
+		fs.BoolVar(&c.printModule, "print-module", false, "Print the module path of go.mod and exit")
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "Usage: goreplace <command> [flags]\n\nCommands:\n")
+			for _, cmd := range commands {
+				fmt.Fprintf(fs.Output(), "  %-22s%s\n", cmd.name, cmd.desc)
+			}
+			fmt.Fprintf(fs.Output(), "\nWithout a command, goreplace applies the config using these flags:\n")
+			fs.PrintDefaults()
+		}
+	case "apply":
+		c.goModFlags(fs)
+		c.configFlags(fs)
+		c.outputFlags(fs)
+		c.writeFlags(fs)
+		fs.BoolVar(&c.tidySum, "tidy-sum", false, "Drop go.sum lines for modules that are replaced with a local directory")
+		c.emitFlags(fs)
+		c.onlyFlag(fs)
+		fs.BoolVar(&c.confirmEach, "confirm-each", false, "Ask before adding each replace; needs a terminal")
+	case "clean":
+		c.clean = true
+		c.goModFlags(fs)
+		c.onlyFlag(fs)
+		c.outputFlags(fs)
+		c.writeFlags(fs)
+	case "check":
+		c.check = true
+		c.goModFlags(fs)
+		c.configFlags(fs)
+		c.writeFlags(fs)
+		fs.BoolVar(&c.fix, "fix", false, "Apply the changes when go.mod is out of date, printing what was fixed")
+	case "list":
+		c.list = true
+		fs.StringVar(&c.goModPath, "gomod", "go.mod.test", "Path to the go.mod file")
+		fs.StringVar(&c.configPath, "config", "replace.yaml", "Path to a config containing find and replace, or - for stdin")
+		fs.StringVar(&c.configExt, "config-ext", "", "Config format (yaml, json, jsonl or env); by default taken from the config file extension")
+		c.mergeStrategyFlag(fs)
+		fs.StringVar(&c.format, "format", "text", "Output format: text or json")
+		c.goModRefFlag(fs)
+		fs.BoolVar(&c.printModule, "print-module", false, "Print the module path of go.mod instead of its replaces")
+		fs.BoolVar(&c.unmatched, "report-unmatched-requires", false, "Print the required modules no config rule matches instead of the replaces")
+	case "diff-config":
+		c.diffConfig = true
+		fs.StringVar(&c.goModPath, "gomod", "go.mod.test", "Path to the go.mod file")
+		fs.StringVar(&c.oldConfig, "old", "", "Path to the config before the change")
+		fs.StringVar(&c.newConfig, "new", "", "Path to the config after the change")
+		fs.StringVar(&c.configExt, "config-ext", "", "Config format (yaml, json, jsonl or env); by default taken from the config file extension")
+		c.mergeStrategyFlag(fs)
+		fs.BoolVar(&c.noValidate, "no-validate", false, "Don't check that local replace targets exist, for configs written on another machine")
+		fs.StringVar(&c.format, "format", "text", "Output format: a unified diff (text) or the removed and added lines (json)")
+		fs.BoolVar(&c.quiet, "quiet", false, "Don't print warnings")
+	case "migrate-to-workspace":
+		c.migrate = true
+		fs.StringVar(&c.goModPath, "gomod", "go.mod.test", "Path to the go.mod file, unless go.mod files are given as arguments")
+		fs.StringVar(&c.configPath, "config", "replace.yaml", "Config whose rules mark replaces as managed, besides those goreplace wrote; may be missing")
+		fs.StringVar(&c.configExt, "config-ext", "", "Config format (yaml, json, jsonl or env); by default taken from the config file extension")
+		c.mergeStrategyFlag(fs)
+		fs.StringVar(&c.workOut, "out", "go.work", "Path of the go.work to write; it must not exist yet")
+		fs.BoolVar(&c.removeReplaces, "remove-replaces", false, "Also remove the migrated local replaces from each go.mod")
+		fs.BoolVar(&c.backup, "backup", false, "Keep a copy of each modified file with a .bak suffix")
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "Usage: goreplace migrate-to-workspace [flags] [go.mod ...]\n")
+			fs.PrintDefaults()
+		}
+	case "completion":
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "Usage: goreplace completion bash|zsh|fish\n")
+		}
+	case "selftest":
+		c.selftest = true
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "Usage: goreplace selftest\n")
+		}
+	case "validate-config":
+		c.validate = true
+		fs.StringVar(&c.configPath, "config", "replace.yaml", "Path to a config containing find and replace, or - for stdin")
+		fs.StringVar(&c.configExt, "config-ext", "", "Config format (yaml, json, jsonl or env); by default taken from the config file extension")
+		c.mergeStrategyFlag(fs)
+	default:
+		return nil, fmt.Errorf("unknown command %q; run goreplace -h for a list of commands", c.command)
+	}
+
+	return fs, nil
+}
+
+// goModFlags registers the flags that select which go.mod files to process.
+func (c *cli) goModFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.goModPath, "gomod", "go.mod.test", "Path to the go.mod file")
+	c.goModRefFlag(fs)
+	fs.StringVar(&c.goWork, "gowork", "", "Path to a go.work file, or a comma-separated list of layered ones; process the go.mod of every module they use")
+	fs.IntVar(&c.concurrency, "concurrency", 1, "Number of go.mod files to plan at once with -gowork")
+	fs.DurationVar(&c.timeout, "timeout", 0, "Give up before the next write if the run takes longer than this (e.g. 30s); with -transactional, also restore the go.mod files already written")
+	fs.BoolVar(&c.trace, "trace", false, "Print the parsed go.mod before and after the changes to stderr")
+	fs.BoolVar(&c.timings, "timings", false, "Print how long each phase took for every go.mod to stderr")
+}
+
+// goModRefFlag registers -gomod-ref, which reads go.mod from git.
+func (c *cli) goModRefFlag(fs *flag.FlagSet) {
+	fs.StringVar(&c.goModRef, "gomod-ref", "", "Read go.mod from a git object given as REF:PATH, such as main:go.mod, without checking it out; read-only")
+}
+
+// onlyFlag registers the flag that restricts a run to some modules.
+func (c *cli) onlyFlag(fs *flag.FlagSet) {
+	fs.Var(&c.only, "only", "Only clean and replace modules matching this pattern (e.g. github.com/acme/*); may be repeated")
+}
+
+// mergeStrategyFlag registers the flag that resolves conflicts between
+// included configs.
+func (c *cli) mergeStrategyFlag(fs *flag.FlagSet) {
+	fs.StringVar(&c.mergeStrategy, "config-merge-strategy", modreplace.MergeStrategies[0], "How to resolve rules for the same module from different configs: "+strings.Join(modreplace.MergeStrategies, ", "))
+}
+
+// configFlags registers the flags that control reading and rendering rules.
+func (c *cli) configFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.configPath, "config", "replace.yaml", "Path to a config containing find and replace, or - for stdin")
+	fs.StringVar(&c.configExt, "config-ext", "", "Config format (yaml, json, jsonl or env); by default taken from the config file extension")
+	c.mergeStrategyFlag(fs)
+	fs.Var(&c.replaceFlags, "replace", "Extra module=path rule that wins over the config, which may then be missing; may be repeated")
+	fs.StringVar(&c.fromLock, "from-lock", "", "Write exactly the replaces this lockfile records for each go.mod, instead of reading the config")
+	fs.BoolVar(&c.noValidate, "no-validate", false, "Don't check that local replace targets exist; go.mod may then fail to build")
+	fs.BoolVar(&c.abortOnParse, "abort-on-parse-warning", false, "Fail on outdated go.mod syntax, such as a module required twice, instead of warning; also fail on go.mod files without a go directive or older than go 1.17")
+	fs.Var(&c.allowModules, "allow-module", "Only allow replacing modules with this path prefix, failing on any other; may be repeated")
+	fs.BoolVar(&c.allowExec, "allow-exec", false, "Run the command of replace targets written as exec:COMMAND and use what it prints as the target")
+	fs.StringVar(&c.template, "template", modreplace.DefaultTemplate, "Go text/template used to render each replace line")
+	fs.BoolVar(&c.strict, "strict", false, "Treat warnings as errors")
+	fs.BoolVar(&c.quiet, "quiet", false, "Don't print warnings")
+	fs.BoolVar(&c.failOnWarnings, "fail-on-warnings", false, "Finish the run, then exit 1 if there were any warnings")
+	fs.BoolVar(&c.noProvenance, "no-provenance", false, "Don't add a comment naming the config each replace came from")
+	fs.BoolVar(&c.relative, "relative", false, "Write absolute local replace targets relative to the go.mod directory")
+	fs.StringVar(&c.relativeTo, "relative-to", "", "Write absolute local replace targets relative to this directory instead of the go.mod directory")
+	fs.BoolVar(&c.noClean, "no-clean", false, "Keep replace directives that no rule writes instead of removing them")
+	fs.StringVar(&c.replaceBase, "replace-base", "", "Directory prepended to every relative replace target in the config")
+	fs.BoolVar(&c.warnUnused, "warn-unused-config", false, "Warn about rules that match no module in the whole run; an error with -strict")
+	fs.IntVar(&c.maxMatches, "max-matches", 0, "Fail if any rule matches more than this many go.mod lines (0 for no limit)")
+	fs.BoolVar(&c.strictTargets, "strict-targets", false, "Fail when different modules are replaced with the same module directory")
+}
+
+// outputFlags registers the flags that preview changes instead of writing.
+func (c *cli) outputFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&c.summaryOnly, "summary-only", false, "Print one line per go.mod counting the replaces added, updated and removed, instead of the details")
+	fs.BoolVar(&c.explain, "explain", false, "Print how each local replace target resolves and whether it exists to stderr")
+	fs.BoolVar(&c.dryRun, "dry-run", false, "Print the resulting go.mod to stdout without writing it; exits 2 if it would change")
+	fs.BoolVar(&c.diff, "diff", false, "Print a unified diff of the changes without writing go.mod")
+	fs.IntVar(&c.diffContext, "diff-context", 3, "Number of context lines to show around each -diff hunk")
+	fs.BoolVar(&c.diffReplaces, "diff-only-replaces", false, "Print only the replace directives that would change, without writing go.mod")
+	fs.BoolVar(&c.dryRunZero, "dry-run-exit-zero", false, "With -dry-run, exit 0 even when go.mod would change, as older releases did")
+	fs.StringVar(&c.dryRunOut, "dry-run-out", "", "With -dry-run, write the resulting go.mod to this file instead of stdout and print its path")
+}
+
+// emitFlags registers the flags that describe the changes for another tool to
+// apply instead of editing go.mod.
+func (c *cli) emitFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.emit, "emit", "", "Leave go.mod alone and print a go build -overlay JSON file (overlay), go mod edit commands (commands) or a patch (patch)")
+	fs.StringVar(&c.output, "output", "", "Write what -emit produces to this file instead of stdout")
+}
+
+// writeFlags registers the flags that control how files are written.
+func (c *cli) writeFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&c.backup, "backup", false, "Keep a copy of each modified file with a .bak suffix")
+	fs.BoolVar(&c.noRename, "no-rename", false, "Truncate and rewrite files in place instead of renaming a temp file over them (not atomic)")
+	fs.StringVar(&c.tempDir, "temp-dir", "", "Create the temp files of atomic writes in this directory instead of next to each file")
+	fs.BoolVar(&c.expectChanges, "expect-changes", false, "Fail, writing nothing, if the run would not change any go.mod")
+	fs.BoolVar(&c.keepTemp, "keep-temp", false, "Keep the temp file of a failed atomic write and print its path, for debugging")
+	fs.BoolVar(&c.forceWrite, "force-write", false, "Rewrite go.mod even when its content would not change")
+	fs.StringVar(&c.header, "header", "", "Comment line written before the block of replaces, and removed with it, e.g. \"// managed by goreplace\"")
+	fs.StringVar(&c.footer, "footer", "", "Comment line written after the block of replaces, and removed with it")
+	fs.StringVar(&c.ensureGo, "ensure-go-version", "", "Add a go directive with this version (e.g. 1.21) if go.mod has none")
+	fs.BoolVar(&c.formatFile, "format-file", false, "Also reformat the whole go.mod canonically, as go mod tidy would")
+	fs.BoolVar(&c.dedupe, "dedupe-existing", false, "Drop replace directives that repeat the module and version of an earlier one, keeping the first")
+	fs.BoolVar(&c.retainOrder, "retain-order", false, "Update existing replace directives where they are instead of moving them into the managed block")
+	fs.BoolVar(&c.transactional, "transactional", false, "If writing any go.mod fails, restore the ones already written")
+	fs.BoolVar(&c.requireClean, "require-clean-worktree", false, "Refuse to modify a go.mod that has uncommitted changes in git")
+	fs.BoolVar(&c.gitAdd, "git-add", false, "Stage go.mod with git add after changing it")
+	fs.StringVar(&c.lockOut, "lock", "", "After writing, record the resulting replaces of every go.mod in this lockfile")
+	fs.BoolVar(&c.verifyGraph, "verify-graph", false, "Before writing, go build each module against its new go.mod to check its local replace targets compile together")
+	fs.BoolVar(&c.verifyList, "verify-list", false, "Run go list -m all after writing go.mod to check the module graph resolves; restores go.mod on failure with -backup")
+}
+
+// setFlagsFromEnv seeds each flag in fs from a GOREPLACE_<NAME> environment
+// variable, with dashes in the flag name written as underscores. Flags given
+// on the command line are parsed afterwards and so take precedence, even
+// those that may be repeated.
+func setFlagsFromEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := "GOREPLACE_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok := os.LookupEnv(name)
+		if !ok || err != nil {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", value, name, setErr)
+		}
+		// Repeatable flags on the command line replace the environment's
+		// value rather than adding to it
+		if values, ok := f.Value.(*stringsFlag); ok {
+			values.fromEnv = true
+		}
+	})
+	return err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRepeatableFlagsFromEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		// flags are the values given on the command line
+		flags []string
+		want  []string
+	}{
+		{"environment only", "example.com/a", nil, []string{"example.com/a"}},
+		{"command line replaces the environment", "example.com/a", []string{"example.com/b"}, []string{"example.com/b"}},
+		{"repeated on the command line", "example.com/a", []string{"example.com/b", "example.com/c"}, []string{"example.com/b", "example.com/c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GOREPLACE_ONLY", tt.env)
+			t.Setenv("GOREPLACE_ALLOW_MODULE", tt.env)
+			args := []string{"apply"}
+			for _, value := range tt.flags {
+				args = append(args, "-only", value, "-allow-module", value)
+			}
+
+			c, err := parseArgs(args)
+			if err != nil {
+				t.Fatalf("parseArgs: %v", err)
+			}
+			if !slices.Equal(c.only.values, tt.want) {
+				t.Errorf("-only is %q, want %q", c.only.values, tt.want)
+			}
+			if !slices.Equal(c.allowModules.values, tt.want) {
+				t.Errorf("-allow-module is %q, want %q", c.allowModules.values, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreviewsAreExclusive(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr bool
+	}{
+		{[]string{"-dry-run"}, false},
+		{[]string{"-diff"}, false},
+		{[]string{"-diff-only-replaces"}, false},
+		{[]string{"-dry-run", "-diff-only-replaces"}, true},
+		{[]string{"-dry-run", "-diff"}, true},
+		{[]string{"-diff", "-diff-only-replaces"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			_, err := parseArgs(append([]string{"apply"}, tt.args...))
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("parseArgs returned %v, want an error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseArgsEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		check   func(c *cli) bool
+		wantErr bool
+	}{
+		{
+			name:  "environment sets a flag",
+			env:   map[string]string{"GOREPLACE_GOMOD": "env.mod"},
+			check: func(c *cli) bool { return c.goModPath == "env.mod" && c.goModSet },
+		},
+		{
+			name:  "command line overrides the environment",
+			env:   map[string]string{"GOREPLACE_GOMOD": "env.mod"},
+			args:  []string{"-gomod", "cli.mod"},
+			check: func(c *cli) bool { return c.goModPath == "cli.mod" },
+		},
+		{
+			name:  "dashes are written as underscores",
+			env:   map[string]string{"GOREPLACE_DRY_RUN": "true", "GOREPLACE_MAX_MATCHES": "3"},
+			check: func(c *cli) bool { return c.dryRun && c.maxMatches == 3 },
+		},
+		{
+			name:  "command line overrides a boolean",
+			env:   map[string]string{"GOREPLACE_DRY_RUN": "true"},
+			args:  []string{"-dry-run=false"},
+			check: func(c *cli) bool { return !c.dryRun },
+		},
+		{
+			name:  "positional arguments override both",
+			env:   map[string]string{"GOREPLACE_GOMOD": "env.mod", "GOREPLACE_CONFIG": "env.yaml"},
+			args:  []string{"-gomod", "cli.mod", "arg.mod", "arg.yaml"},
+			check: func(c *cli) bool { return c.goModPath == "arg.mod" && c.configPath == "arg.yaml" },
+		},
+		{
+			name:    "invalid environment value",
+			env:     map[string]string{"GOREPLACE_MAX_MATCHES": "many"},
+			wantErr: true,
+		},
+		{
+			name:    "environment values are validated like flags",
+			env:     map[string]string{"GOREPLACE_MAX_MATCHES": "-1"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			c, err := parseArgs(append([]string{"apply"}, tt.args...))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("parseArgs succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseArgs: %v", err)
+			}
+			if !tt.check(c) {
+				t.Errorf("parseArgs gave %+v", *c)
+			}
+		})
+	}
+}
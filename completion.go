@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// completionShells are the shells goreplace can print completions for.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// commandFlags returns the names of the flags command accepts, with their
+// leading dash, and the usage of each.
+func commandFlags(command string) ([]string, map[string]string) {
+	fs, err := (&cli{command: command}).flagSet()
+	if err != nil {
+		return nil, nil
+	}
+
+	var names []string
+	usage := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		names = append(names, "-"+f.Name)
+		usage["-"+f.Name] = f.Usage
+	})
+	return names, usage
+}
+
+// writeCompletion writes a completion script for shell to w, covering every
+// command and its flags. The flags of running goreplace without a command
+// complete when no command is given.
+func writeCompletion(w io.Writer, shell string) error {
+	var names []string
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+	}
+	legacy, legacyUsage := commandFlags("")
+
+	var b strings.Builder
+	switch shell {
+	case "bash":
+		fmt.Fprintf(&b, "_goreplace() {\n")
+		fmt.Fprintf(&b, "\tlocal cur=${COMP_WORDS[COMP_CWORD]}\n")
+		fmt.Fprintf(&b, "\tif [ \"$COMP_CWORD\" -eq 1 ]; then\n")
+		fmt.Fprintf(&b, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(append(names, legacy...), " "))
+		fmt.Fprintf(&b, "\t\treturn\n\tfi\n")
+		fmt.Fprintf(&b, "\tcase ${COMP_WORDS[1]} in\n")
+		for _, name := range names {
+			flags, _ := commandFlags(name)
+			fmt.Fprintf(&b, "\t%s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", name, strings.Join(flags, " "))
+		}
+		fmt.Fprintf(&b, "\t*) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", strings.Join(legacy, " "))
+		fmt.Fprintf(&b, "\tesac\n}\n")
+		fmt.Fprintf(&b, "complete -o default -F _goreplace goreplace\n")
+	case "zsh":
+		fmt.Fprintf(&b, "#compdef goreplace\n\n")
+		fmt.Fprintf(&b, "_goreplace() {\n\tlocal -a flags\n")
+		fmt.Fprintf(&b, "\tcase $words[2] in\n")
+		for _, name := range names {
+			flags, _ := commandFlags(name)
+			fmt.Fprintf(&b, "\t%s) flags=(%s) ;;\n", name, strings.Join(flags, " "))
+		}
+		fmt.Fprintf(&b, "\t*) flags=(%s) ;;\n", strings.Join(legacy, " "))
+		fmt.Fprintf(&b, "\tesac\n")
+		fmt.Fprintf(&b, "\tif (( CURRENT == 2 )); then\n\t\tcompadd -- %s $flags\n", strings.Join(names, " "))
+		fmt.Fprintf(&b, "\telse\n\t\tcompadd -- $flags\n\tfi\n")
+		fmt.Fprintf(&b, "\t_files\n}\n\n")
+		fmt.Fprintf(&b, "compdef _goreplace goreplace\n")
+	case "fish":
+		for _, cmd := range commands {
+			fmt.Fprintf(&b, "complete -c goreplace -f -n __fish_use_subcommand -a %s -d %s\n", cmd.name, fishQuote(cmd.desc))
+		}
+		for _, flag := range legacy {
+			fmt.Fprintf(&b, "complete -c goreplace -n __fish_use_subcommand -o %s -d %s\n",
+				strings.TrimPrefix(flag, "-"), fishQuote(legacyUsage[flag]))
+		}
+		for _, name := range names {
+			flags, usage := commandFlags(name)
+			for _, flag := range flags {
+				fmt.Fprintf(&b, "complete -c goreplace -n '__fish_seen_subcommand_from %s' -o %s -d %s\n",
+					name, strings.TrimPrefix(flag, "-"), fishQuote(usage[flag]))
+			}
+		}
+	default:
+		return fmt.Errorf("no completion for shell %q", shell)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// fishQuote quotes s as a single-quoted fish string.
+func fishQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return "'" + strings.ReplaceAll(s, "'", `\'`) + "'"
+}
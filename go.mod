@@ -2,4 +2,7 @@ module goreplace
 
 go 1.21
 
-require gopkg.in/yaml.v3 v3.0.1
+require (
+	golang.org/x/mod v0.20.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -2,225 +2,785 @@ package main
 
 import (
 	"bufio"
-	"flag"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"text/tabwriter"
 
-	"gopkg.in/yaml.v3"
+	"goreplace/modreplace"
 )
 
-// FindReplace is an object represent in a specified yaml config
-type FindReplace struct {
-	Find    string `yaml:"find"`
-	Replace string `yaml:"replace"`
-}
-
 func main() {
 	// Parse command-line arguments
-	goModPath := flag.String("gomod", "go.mod.test", "Path to the go.mod file")
-	goModConfigPath := flag.String("config", "replace.yaml", "Path to a config containing find and replace")
-	clean := flag.Bool("clean", false, "Remove all replace cmds")
-	flag.Parse()
-
-	if err := deleteLinesWithReplace(*goModPath); err != nil {
+	c, err := parseArgs(os.Args[1:])
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	// If clean, our job here is done
-	if *clean {
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, c.timeout, fmt.Errorf("timed out after %s", c.timeout))
+		defer cancel()
+	}
+
+	// Every write checks ctx before it starts, so a timeout stops the run
+	// between writes, never in the middle of one
+	c.run(ctx)
+}
+
+// run carries out the command c describes.
+func (c *cli) run(ctx context.Context) {
+	if c.shell != "" {
+		if err := writeCompletion(os.Stdout, c.shell); err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
 
-	// Read the find replace config
-	find, err := readYamlConfig(*goModConfigPath)
-	if err != nil {
-		log.Fatal(err)
+	if c.selftest {
+		if !selftest(os.Stdout) {
+			fmt.Println("FAIL")
+			os.Exit(1)
+		}
+		fmt.Println("OK")
+		return
 	}
 
-	// Scan go mod for any matching modules
-	replace, err := findMatchesInFile(*goModPath, find)
-	if err != nil {
-		log.Fatal(err)
+	if c.migrate {
+		c.migrateToWorkspace()
+		return
 	}
 
-	// Validate replace mods exist
-	if err = validateLocalReposExist(replace); err != nil {
-		log.Fatal(err)
+	if c.diffConfig {
+		c.diffConfigs()
+		return
 	}
 
-	// Append replace statements to go.mod
-	if err = appendModReplace(*goModPath, replace); err != nil {
-		log.Fatal(err)
+	// Validating a config needs no go.mod at all
+	if c.validate {
+		problems := modreplace.ConfigProblems(c.configPath, c.configExt, c.mergeStrategy)
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) != 0 {
+			os.Exit(1)
+		}
+		return
 	}
-}
 
-func readYamlConfig(filePath string) ([]FindReplace, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return nil, err
+	// A config can name the go.mod it manages; -gomod still wins
+	if !c.goModSet && c.goWork == "" && c.configPath != "" && c.configPath != "-" {
+		goModPath, err := modreplace.ConfigGoMod(c.configPath, c.configExt, c.mergeStrategy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if goModPath != "" {
+			c.goModPath = goModPath
+		}
 	}
-	defer file.Close()
 
-	byteValue, err := io.ReadAll(file)
-	if err != nil {
-		return nil, err
+	// Printing the module path only reads go.mod
+	if c.printModule {
+		modulePath, err := modreplace.ReadModulePath(c.goModPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if c.format == "json" {
+			err = json.NewEncoder(os.Stdout).Encode(struct {
+				Module string `json:"module"`
+			}{modulePath})
+		} else {
+			_, err = fmt.Println(modulePath)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	var findReplaces []FindReplace
-	err = yaml.Unmarshal(byteValue, &findReplaces)
-	if err != nil {
-		return nil, err
+	// Reporting unmatched requires only reads go.mod and the config
+	if c.unmatched {
+		modules, err := modreplace.UnmatchedRequires(c.goModPath, c.goModRef, c.configPath, c.configExt, c.mergeStrategy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if c.format == "json" {
+			err = json.NewEncoder(os.Stdout).Encode(modules)
+		} else {
+			_, err = fmt.Print(strings.Join(append(modules, ""), "\n"))
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	return findReplaces, nil
-}
+	// Listing only reads go.mod and the config
+	if c.list {
+		replaces, err := modreplace.ListReplaces(c.goModPath, c.goModRef, c.configPath, c.configExt, c.mergeStrategy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = printReplaces(os.Stdout, replaces, c.format); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var explainWriter io.Writer
+	if c.explain {
+		explainWriter = os.Stderr
+	}
+
+	opts := modreplace.Options{
+		GoModPath:     c.goModPath,
+		ConfigPath:    c.configPath,
+		ConfigExt:     c.configExt,
+		MergeStrategy: c.mergeStrategy,
+		Clean:         c.clean,
+		Template:      c.template,
+		TidySum:       c.tidySum,
+		Backup:        c.backup,
+		NoRename:      c.noRename,
+		GoModRef:      c.goModRef,
+		TempDir:       c.tempDir,
+		KeepTemp:      c.keepTemp,
+		VerifyList:    c.verifyList,
+		AllowExec:     c.allowExec,
+		NoValidate:    c.noValidate,
+		FromLock:      c.fromLock,
+		Rules:         c.rules,
+		GoVersion:     c.ensureGo,
+		Dedupe:        c.dedupe,
+		AllowModules:  c.allowModules.values,
+		AbortOnParse:  c.abortOnParse,
+		Strict:        c.strict,
+		ForceWrite:    c.forceWrite,
+		StrictTargets: c.strictTargets,
+		ReplaceBase:   c.replaceBase,
+		Only:          c.only.values,
+		Context:       ctx,
+		FormatFile:    c.formatFile,
+		MaxMatches:    c.maxMatches,
+		RequireClean:  c.requireClean,
+		Relative:      c.relative,
+		NoProvenance:  c.noProvenance,
+		RetainOrder:   c.retainOrder,
+		NoClean:       c.noClean,
+		RelativeTo:    c.relativeTo,
+		Explain:       explainWriter,
+		Header:        c.header,
+		Footer:        c.footer,
+	}
+	// The config is read once for every go.mod, as standard input can only
+	// be read once
+	if !opts.Clean && opts.FromLock == "" {
+		config, err := modreplace.ReadConfig(opts.ConfigPath, opts.ConfigExt, opts.MergeStrategy, opts.Rules)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Config = config
+	}
+	if opts.TempDir != "" {
+		if err := modreplace.CheckTempDir(opts.TempDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if opts.NoRename && !opts.Backup {
+		c.warn("-no-rename is not atomic; consider using -backup")
+	}
+
+	// A workspace runs the same pipeline over every member module
+	goModPaths := []string{c.goModPath}
+	if c.goWork != "" {
+		var err error
+		var overrides []string
+		goModPaths, overrides, err = modreplace.LayeredModules(strings.Split(c.goWork, ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(overrides) != 0 && c.strict {
+			log.Fatalf("go.work layers override modules:\n%s", strings.Join(overrides, "\n"))
+		}
+		for _, msg := range overrides {
+			c.warn(msg)
+		}
+	}
 
-func findMatchesInFile(filePath string, find []FindReplace) ([]FindReplace, error) {
-	file, err := os.Open(filePath)
+	// Every plan is computed before anything is written, so a bad module
+	// fails the run without leaving the others half updated
+	plans, errs, err := modreplace.NewPlans(opts, goModPaths, c.concurrency)
 	if err != nil {
-		return nil, err
+		log.Fatal(err)
 	}
-	defer file.Close()
+	for i, plan := range plans {
+		path := goModPaths[i]
+		if errs[i] != nil {
+			log.Fatal(memberError(c.goWork, path, errs[i]))
+		}
+		for _, msg := range plan.Warnings {
+			c.warn(msg)
+		}
+		if len(plan.Deduped) != 0 && !c.quiet {
+			log.Printf("%s: dropping %d duplicate replace directives", path, len(plan.Deduped))
+		}
 
-	var found []FindReplace
+		if c.confirmEach {
+			if err = confirmEach(os.Stdin, os.Stderr, plan); err != nil {
+				log.Fatal(memberError(c.goWork, path, err))
+			}
+		}
+	}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
+	// A run that changes nothing usually points at the wrong go.mod or config
+	if c.expectChanges {
+		changed := false
+		for _, plan := range plans {
+			if changed, err = plan.Changed(); err != nil {
+				log.Fatal(memberError(c.goWork, plan.GoModPath, err))
+			}
+			if changed {
+				break
+			}
+		}
+		if !changed {
+			log.Fatal("-expect-changes: the run would not change any go.mod; check -gomod and -config")
+		}
+	}
 
-		for _, cmd := range find {
-			if strings.Contains(line, cmd.Find) {
-				found = append(found, cmd)
+	// Building against the planned go.mods catches local targets that only
+	// break together, before anything is written
+	if c.verifyGraph {
+		for _, plan := range plans {
+			content, err := plan.Content()
+			if err == nil {
+				err = modreplace.BuildWithContent(ctx, plan.GoModPath, content)
+			}
+			if err != nil {
+				log.Fatal(memberError(c.goWork, plan.GoModPath, err))
 			}
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	// apply writes a plan; under -transactional a failure first restores
+	// every go.mod already written, including one the failing plan wrote
+	// before a later step such as -verify-list failed
+	var applied []*modreplace.Plan
+	apply := func(plan *modreplace.Plan) {
+		warned := len(plan.Warnings)
+		err := modreplace.Apply(plan)
+		// Writing can warn too, such as when -temp-dir can't be used
+		for _, msg := range plan.Warnings[warned:] {
+			c.warn(msg)
+		}
+		if err != nil {
+			if c.transactional {
+				rollback(append(applied, plan))
+			}
+			log.Fatal(memberError(c.goWork, plan.GoModPath, err))
+		}
+		applied = append(applied, plan)
 	}
 
-	return found, nil
-}
+	// A rule that applies nowhere in the run is probably dead config
+	if c.warnUnused {
+		if unused := modreplace.UnusedRules(plans); len(unused) != 0 {
+			if c.strict {
+				log.Fatalf("unused rules:\n%s", strings.Join(unused, "\n"))
+			}
+			for _, msg := range unused {
+				c.warn(msg)
+			}
+		}
+	}
+
+	// JSON output stays machine readable, so it never gets a summary line
+	summaryOnly := c.summaryOnly && c.format != "json"
 
-func validateLocalReposExist(replace []FindReplace) error {
-	var missing []string
+	outOfDate := false
+	wouldChange := false
+	overlay := make(map[string]string)
+	var patch strings.Builder
 
-	for _, cmd := range replace {
-		exists, err := dirExists(cmd.Replace)
+	// What -emit produces goes to stdout or -output
+	var out io.Writer = os.Stdout
+	if c.output != "" {
+		f, err := os.Create(c.output)
 		if err != nil {
-			missing = append(missing, err.Error())
-			continue
+			log.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	for _, plan := range plans {
+		path := plan.GoModPath
+
+		if c.trace {
+			content, err := plan.Content()
+			if err != nil {
+				log.Fatal(memberError(c.goWork, path, err))
+			}
+			if err = modreplace.TraceModFile(os.Stderr, "before", path, plan.Original); err != nil {
+				log.Fatal(memberError(c.goWork, path, err))
+			}
+			if err = modreplace.TraceModFile(os.Stderr, "after", path, content); err != nil {
+				log.Fatal(memberError(c.goWork, path, err))
+			}
+		}
+
+		// Read-only modes never touch the file, so they work on read-only
+		// targets such as a go.mod inside the module cache
+		switch {
+		case c.emit == "overlay":
+			content, err := plan.Content()
+			if err != nil {
+				log.Fatal(memberError(c.goWork, path, err))
+			}
+			if err = addOverlay(overlay, path, content); err != nil {
+				log.Fatal(memberError(c.goWork, path, err))
+			}
+		case c.emit == "patch":
+			content, err := plan.Content()
+			if err != nil {
+				log.Fatal(memberError(c.goWork, path, err))
+			}
+			patch.WriteString(modreplace.UnifiedDiff(patchPath(path), plan.Original, content, 3))
+		case c.emit == "commands":
+			for _, line := range plan.Remove {
+				fmt.Fprintln(out, goModDropCommand(path, line))
+			}
+			for _, cmd := range plan.Add {
+				fmt.Fprintln(out, goModEditCommand(path, cmd))
+			}
+		case c.dryRun:
+			content, err := plan.Content()
+			if err != nil {
+				log.Fatal(memberError(c.goWork, path, err))
+			}
+			if c.dryRunOut != "" {
+				// Keep the preview off stdout so CI can archive it
+				if err = os.MkdirAll(filepath.Dir(c.dryRunOut), 0o755); err != nil {
+					log.Fatal(err)
+				}
+				if err = os.WriteFile(c.dryRunOut, content, 0o644); err != nil {
+					log.Fatal(err)
+				}
+				if !summaryOnly {
+					fmt.Println(c.dryRunOut)
+				}
+			} else if !summaryOnly {
+				if c.goWork != "" {
+					fmt.Printf("// %s\n", path)
+				}
+				if _, err := os.Stdout.Write(content); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if !bytes.Equal(plan.Original, content) {
+				wouldChange = true
+			}
+			if summaryOnly {
+				if err = printSummary(path, plan, true); err != nil {
+					log.Fatal(memberError(c.goWork, path, err))
+				}
+			}
+		case c.diffReplaces:
+			changes, err := plan.ReplaceChanges()
+			if err != nil {
+				log.Fatal(memberError(c.goWork, path, err))
+			}
+			if c.goWork != "" && len(changes) != 0 {
+				fmt.Printf("// %s\n", path)
+			}
+			for _, change := range changes {
+				if change.Before != "" {
+					fmt.Printf("- %s\n", change.Before)
+				}
+				if change.After != "" {
+					fmt.Printf("+ %s\n", change.After)
+				}
+			}
+		case c.diff:
+			content, err := plan.Content()
+			if err != nil {
+				log.Fatal(memberError(c.goWork, path, err))
+			}
+			fmt.Print(modreplace.UnifiedDiff(path, plan.Original, content, c.diffContext))
+		case c.check:
+			changed, err := plan.Changed()
+			if err != nil {
+				log.Fatal(memberError(c.goWork, path, err))
+			}
+			if !changed {
+				break
+			}
+			if !c.fix {
+				log.Printf("%s is not up to date", path)
+				outOfDate = true
+				break
+			}
+
+			// Fixing is an ordinary apply, so backups and atomic writes hold
+			content, err := plan.Content()
+			if err != nil {
+				log.Fatal(memberError(c.goWork, path, err))
+			}
+			apply(plan)
+			fmt.Printf("fixed %s\n", path)
+			fmt.Print(modreplace.UnifiedDiff(path, plan.Original, content, 0))
+			c.stage(path)
+		default:
+			if c.clean && len(c.only.values) != 0 && !summaryOnly {
+				fmt.Printf("%s: removed %d replace directives\n", path, len(plan.Remove))
+			}
+			changed, err := plan.Changed()
+			if err != nil {
+				log.Fatal(memberError(c.goWork, path, err))
+			}
+			apply(plan)
+			if changed {
+				c.stage(path)
+			}
+			if summaryOnly {
+				if err = printSummary(path, plan, false); err != nil {
+					log.Fatal(memberError(c.goWork, path, err))
+				}
+			} else if c.goWork != "" {
+				status := "unchanged"
+				if changed {
+					status = "updated"
+				}
+				fmt.Printf("%s: %s\n", path, status)
+			}
 		}
 
-		if !exists {
-			missing = append(missing, cmd.Replace)
+		if c.timings {
+			for _, t := range plan.Timings {
+				fmt.Fprintf(os.Stderr, "%s: %s took %s\n", path, t.Phase, t.Duration)
+			}
 		}
 	}
 
-	if len(missing) != 0 {
-		combinedMissingStr := strings.Join(missing, "\n")
-		return fmt.Errorf("replace module error(s) or missing:\n%s", combinedMissingStr)
+	// The overlay and patch cover every go.mod, so they are printed once at
+	// the end
+	switch c.emit {
+	case "overlay":
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(struct{ Replace map[string]string }{overlay}); err != nil {
+			log.Fatal(err)
+		}
+	case "patch":
+		if _, err := io.WriteString(out, patch.String()); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	return nil
+	// The lock records what was written, so previews and stale checks skip it
+	writing := c.emit == "" && !c.dryRun && !c.diff && !c.diffReplaces && (!c.check || c.fix)
+	if c.lockOut != "" && writing {
+		if err := modreplace.WriteLock(c.lockOut, plans); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if outOfDate || (c.failOnWarnings && c.warned) {
+		os.Exit(1)
+	}
+	// Scripts can tell from a dry run whether applying would change anything
+	if wouldChange && !c.dryRunZero {
+		os.Exit(2)
+	}
 }
 
-// dirExists checks if a given path exists and is a directory.
-func dirExists(path string) (bool, error) {
-	info, err := os.Stat(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// The path does not exist
-			return false, nil
-		}
-		// There was some other error accessing the path
-		return false, err
+// warn prints msg as a warning unless -quiet is set, and records that the
+// run had a warning either way.
+func (c *cli) warn(msg string) {
+	c.warned = true
+	if !c.quiet {
+		log.Printf("warning: %s", msg)
 	}
-	// The path exists; check if it's a directory
-	return info.IsDir(), nil
 }
 
-func appendModReplace(goModPath string, replace []FindReplace) error {
-	// Read the original file content
-	originalContent, err := os.ReadFile(goModPath)
+// printSummary prints the single line -summary-only reports for the go.mod
+// at path: how many replace directives the plan adds, updates and removes.
+func printSummary(path string, plan *modreplace.Plan, dryRun bool) error {
+	changes, err := plan.ReplaceChanges()
 	if err != nil {
 		return err
 	}
 
-	// Create a temporary file
-	tempFile, err := os.CreateTemp(filepath.Dir(goModPath), "go.mod.temp")
-	if err != nil {
-		return err
+	var added, updated, removed int
+	for _, change := range changes {
+		switch {
+		case change.Before == "":
+			added++
+		case change.After == "":
+			removed++
+		default:
+			updated++
+		}
 	}
-	defer tempFile.Close()
-	defer os.Remove(tempFile.Name()) // Clean up
 
-	// Write the original content to the temporary file
-	_, err = tempFile.Write(originalContent)
+	if dryRun {
+		fmt.Printf("%s: would add %d, update %d and remove %d replace directives\n", path, added, updated, removed)
+	} else {
+		fmt.Printf("%s: added %d, updated %d and removed %d replace directives\n", path, added, updated, removed)
+	}
+	return nil
+}
+
+// migrateToWorkspace writes a go.work for the managed local replaces of the
+// go.mods in c.goModPaths, then removes those replaces if asked to.
+func (c *cli) migrateToWorkspace() {
+	// Never clobber a workspace someone already set up
+	if _, err := os.Stat(c.workOut); err == nil {
+		log.Fatalf("%s already exists", c.workOut)
+	}
+
+	config, err := modreplace.ReadConfig(c.configPath, c.configExt, c.mergeStrategy, nil)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatal(err)
+	}
+
+	m, err := modreplace.MigrateToWorkspace(c.workOut, c.goModPaths, config)
 	if err != nil {
-		return err
+		log.Fatal(err)
+	}
+	if err = os.WriteFile(c.workOut, m.Work, 0o644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("wrote %s\n", c.workOut)
+
+	if !c.removeReplaces {
+		return
 	}
+	for _, path := range c.goModPaths {
+		removed, err := m.DropLocalReplaces(path, c.backup)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if removed > 0 {
+			fmt.Printf("removed %d local replaces from %s\n", removed, path)
+		}
+	}
+}
 
-	// Append the new lines
-	for _, cmd := range replace {
-		_, err = tempFile.WriteString(fmt.Sprintf("replace %s => %s\n", cmd.Find, cmd.Replace))
+// ConfigDelta is how the go.mod written from one config differs from the
+// one written from another.
+type ConfigDelta struct {
+	Removed []string `json:"removed"`
+	Added   []string `json:"added"`
+}
+
+// diffConfigs prints how the go.mod at c.goModPath planned from c.oldConfig
+// differs from the one planned from c.newConfig. Nothing is written.
+func (c *cli) diffConfigs() {
+	var contents [2][]byte
+	for i, configPath := range []string{c.oldConfig, c.newConfig} {
+		plan, err := modreplace.NewPlan(modreplace.Options{
+			GoModPath:     c.goModPath,
+			ConfigPath:    configPath,
+			ConfigExt:     c.configExt,
+			MergeStrategy: c.mergeStrategy,
+			NoValidate:    c.noValidate,
+		})
 		if err != nil {
-			return err
+			log.Fatalf("%s: %v", configPath, err)
+		}
+		for _, msg := range plan.Warnings {
+			c.warn(fmt.Sprintf("%s: %s", configPath, msg))
+		}
+		if contents[i], err = plan.Content(); err != nil {
+			log.Fatalf("%s: %v", configPath, err)
+		}
+	}
+
+	if c.format != "json" {
+		fmt.Print(modreplace.UnifiedDiff(c.goModPath, contents[0], contents[1], 3))
+		return
+	}
+	removed, added := modreplace.ChangedLines(contents[0], contents[1])
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(ConfigDelta{Removed: removed, Added: added}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// rollback restores the go.mod and go.sum each plan in applied started from,
+// most recent first, reporting each one.
+func rollback(applied []*modreplace.Plan) {
+	for i := len(applied) - 1; i >= 0; i-- {
+		if !applied[i].Written() {
+			continue
+		}
+		if err := modreplace.Rollback(applied[i]); err != nil {
+			log.Printf("failed to roll back %s: %v", applied[i].GoModPath, err)
+			continue
 		}
+		log.Printf("rolled back %s", applied[i].GoModPath)
 	}
+}
 
-	// Close the temporary file
-	if err := tempFile.Close(); err != nil {
+// stage runs git add on a go.mod that was just changed, when -git-add is set
+// and the go.mod is in a git repository.
+func (c *cli) stage(goModPath string) {
+	if !c.gitAdd || !modreplace.InGitRepo(filepath.Dir(goModPath)) {
+		return
+	}
+	if err := modreplace.GitAdd(goModPath); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("staged %s\n", goModPath)
+}
+
+// confirmEach asks on out about each replace plan adds and keeps those the
+// user answers yes to on in, which must be a terminal. Existing directives
+// for the modules declined are removed as the plan would otherwise.
+func confirmEach(in *os.File, out io.Writer, plan *modreplace.Plan) error {
+	info, err := in.Stat()
+	if err != nil {
 		return err
 	}
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return errors.New("-confirm-each needs a terminal to ask on")
+	}
 
-	// Replace the original file with the temporary file
-	return os.Rename(tempFile.Name(), goModPath)
+	reader := bufio.NewReader(in)
+	plan.FilterAdd(func(cmd modreplace.FindReplace) bool {
+		// After a failed read every remaining replace is declined
+		if err != nil {
+			return false
+		}
+		target := cmd.Replace
+		if cmd.Version != "" {
+			target += " " + cmd.Version
+		}
+		fmt.Fprintf(out, "replace %s => %s? [y/N] ", cmd.Find, target)
+
+		answer, readErr := reader.ReadString('\n')
+		if errors.Is(readErr, io.EOF) && answer == "" {
+			err = errors.New("-confirm-each got no answer")
+			return false
+		}
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			err = readErr
+			return false
+		}
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes"
+	})
+	return err
 }
 
-func deleteLinesWithReplace(filePath string) error {
-	// Open the original file
-	originalFile, err := os.Open(filePath)
+// addOverlay writes content to a temporary file and records it in overlay as
+// the replacement for the go.mod at goModPath, in the form go build -overlay
+// expects.
+func addOverlay(overlay map[string]string, goModPath string, content []byte) error {
+	absPath, err := filepath.Abs(goModPath)
 	if err != nil {
 		return err
 	}
-	defer originalFile.Close()
 
-	// Create a temporary file
-	tempFile, err := os.CreateTemp(filepath.Dir(filePath), "go.mod.temp")
+	tempFile, err := os.CreateTemp("", "goreplace-*.go.mod")
 	if err != nil {
 		return err
 	}
 	defer tempFile.Close()
-	defer os.Remove(tempFile.Name()) // Cleanup in case of error
 
-	// Scanner to read the original file
-	scanner := bufio.NewScanner(originalFile)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "replace") {
-			if _, err := tempFile.WriteString(line + "\n"); err != nil {
-				return err
-			}
-		}
+	if _, err = tempFile.Write(content); err != nil {
+		return err
 	}
-
-	if err := scanner.Err(); err != nil {
+	if err = tempFile.Close(); err != nil {
 		return err
 	}
 
-	// Close files to ensure all data is written
-	if err := originalFile.Close(); err != nil {
-		return err
+	overlay[absPath] = tempFile.Name()
+	return nil
+}
+
+// patchPath names the go.mod at path in a patch, relative to the current
+// directory so the patch applies with git apply or patch -p1 from there.
+func patchPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// goModEditCommand returns the go mod edit command that adds the replace cmd
+// to the go.mod at goModPath, quoted for a POSIX shell.
+func goModEditCommand(goModPath string, cmd modreplace.FindReplace) string {
+	target := cmd.Replace
+	if cmd.Version != "" {
+		target += "@" + cmd.Version
+	}
+	return fmt.Sprintf("go mod edit %s %s", shellQuote("-replace="+cmd.Find+"="+target), shellQuote(goModPath))
+}
+
+// goModDropCommand returns the go mod edit command that removes the replace
+// directive line from the go.mod at goModPath.
+func goModDropCommand(goModPath, line string) string {
+	old := modreplace.ReplaceModule(line)
+	if fields := strings.Fields(line); len(fields) > 3 && fields[2] != "=>" {
+		old += "@" + fields[2]
+	}
+	return fmt.Sprintf("go mod edit %s %s", shellQuote("-dropreplace="+old), shellQuote(goModPath))
+}
+
+// shellQuote quotes s as a single word for a POSIX shell, leaving it bare
+// when that is already safe.
+func shellQuote(s string) string {
+	safe := s != "" && !strings.ContainsFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@%_+=:,./-", r))
+	})
+	if safe {
+		return s
 	}
-	if err := tempFile.Close(); err != nil {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// memberError prefixes err with the go.mod it concerns when running over a
+// workspace, where it could be any of several files.
+func memberError(goWork, goModPath string, err error) error {
+	if goWork == "" {
 		return err
 	}
+	return fmt.Errorf("%s: %w", goModPath, err)
+}
+
+// printReplaces writes replaces to w as a table or as JSON.
+func printReplaces(w io.Writer, replaces []modreplace.ListedReplace, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(replaces)
+	}
 
-	// Replace the original file with the temp file
-	return os.Rename(tempFile.Name(), filePath)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODULE\tTARGET\tVERSION\tMANAGED")
+	for _, r := range replaces {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%t\n", r.Module, r.Target, r.Version, r.Managed)
+	}
+	return tw.Flush()
 }
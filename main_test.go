@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"go.mod", "go.mod"},
+		{"-replace=example.com/a=../a@v1.0.0", "-replace=example.com/a=../a@v1.0.0"},
+		{"", "''"},
+		{"my dir/go.mod", "'my dir/go.mod'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME", "'$HOME'"},
+		{"a;b", "'a;b'"},
+		{"*", "'*'"},
+	}
+	for _, tt := range tests {
+		if got := shellQuote(tt.in); got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
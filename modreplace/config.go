@@ -0,0 +1,778 @@
+package modreplace
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigExts are the config formats goreplace can decode.
+var ConfigExts = []string{"yaml", "json", "jsonl", "env"}
+
+// maxIncludeDepth limits how deeply configs may include other configs.
+const maxIncludeDepth = 8
+
+// configVersion is the config format version this release reads.
+const configVersion = 1
+
+// RulesEnv names the environment variable holding extra module=path rules.
+const RulesEnv = "GOREPLACE_RULES"
+
+// MergeStrategies are the ways rules for the same module from different
+// configs can be reconciled; the first is the default.
+var MergeStrategies = []string{"error", "last-wins", "first-wins"}
+
+// ReadConfig reads the config at filePath, or standard input when filePath is
+// "-". The format comes from ext when set and from the file extension
+// otherwise, falling back to YAML. strategy resolves conflicts between
+// included configs. Rules from GOREPLACE_RULES and then extra are merged in
+// after the config's own and always win.
+func ReadConfig(filePath, ext, strategy string, extra []FindReplace) (*Config, error) {
+	value, ok := os.LookupEnv(RulesEnv)
+	if !ok && len(extra) == 0 {
+		return loadConfig(filePath, ext, strategy, nil)
+	}
+
+	envRules, err := parseEnvRules(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", RulesEnv, err)
+	}
+	extra = slices.Clone(extra)
+	for _, rules := range [][]FindReplace{envRules, extra} {
+		for i := range rules {
+			rules[i].position = i + 1
+		}
+	}
+
+	// Ephemeral overrides don't need a config file at all
+	config := &Config{}
+	if _, err = os.Stat(filePath); filePath == "-" || !errors.Is(err, fs.ErrNotExist) {
+		config, err = loadConfig(filePath, ext, strategy, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	config.Rules, err = mergeRuleGroups([][]FindReplace{config.Rules, envRules, extra}, "last-wins")
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ConfigGoMod returns the go.mod the config at filePath names, resolved
+// relative to the config, or "" when it names none. A missing config names
+// none either.
+func ConfigGoMod(filePath, ext, strategy string) (string, error) {
+	if _, err := os.Stat(filePath); errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+
+	config, err := loadConfig(filePath, ext, strategy, nil)
+	if err != nil || config.GoMod == "" {
+		return "", err
+	}
+
+	if filepath.IsAbs(config.GoMod) {
+		return config.GoMod, nil
+	}
+	return filepath.Join(filepath.Dir(filePath), config.GoMod), nil
+}
+
+// parseEnvRules parses rules of the form "module=path;module2=path2". A
+// backslash escapes the character after it, so paths may contain ; and =.
+func parseEnvRules(value string) ([]FindReplace, error) {
+	var rules []FindReplace
+	for _, entry := range splitEscaped(value, ';') {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		rule, err := ParseRule(entry, RulesEnv)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// ParseRule parses a single "module=path" find rule from source. A backslash
+// escapes the character after it.
+func ParseRule(entry, source string) (FindReplace, error) {
+	parts := splitEscaped(entry, '=')
+	if len(parts) != 2 {
+		return FindReplace{}, fmt.Errorf("rule %q is not of the form module=path", entry)
+	}
+	find := unescape(strings.TrimSpace(parts[0]))
+	replace := unescape(strings.TrimSpace(parts[1]))
+	if find == "" || replace == "" {
+		return FindReplace{}, fmt.Errorf("rule %q is not of the form module=path", entry)
+	}
+
+	return FindReplace{Find: find, Replace: replace, source: source}, nil
+}
+
+// splitEscaped splits s around each sep not preceded by a backslash, leaving
+// escapes in place.
+func splitEscaped(s string, sep rune) []string {
+	var parts []string
+	var part strings.Builder
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == sep:
+			parts = append(parts, part.String())
+			part.Reset()
+			continue
+		}
+		part.WriteRune(r)
+	}
+	return append(parts, part.String())
+}
+
+// unescape drops the backslash from each escape in s.
+func unescape(s string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range s {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// loadConfig reads the config at filePath and splices in the rules of the
+// configs it includes, resolving conflicts between them with strategy. stack
+// holds the configs that led to this one.
+func loadConfig(filePath, ext, strategy string, stack []string) (*Config, error) {
+	var r io.Reader = os.Stdin
+	if filePath != "-" {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	if ext == "" {
+		ext = strings.TrimPrefix(filepath.Ext(filePath), ".")
+	}
+
+	// Line-based formats are decoded as they stream in; other formats need
+	// the whole document
+	var config *Config
+	var err error
+	switch ext {
+	case "jsonl":
+		config, err = decodeJSONLConfig(r)
+	case "env":
+		config, err = decodeEnvConfig(r)
+	case "toml":
+		// Reading it as YAML, the fallback, would only give confusing errors
+		return nil, fmt.Errorf("%s: TOML configs are not supported; use YAML or JSON", filePath)
+	default:
+		var byteValue []byte
+		byteValue, err = io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		switch ext {
+		case "json":
+			config, err = decodeJSONConfig(byteValue)
+		default:
+			config, err = decodeYamlConfig(byteValue)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Configs without a version predate it and are version 1
+	if config.Version == 0 {
+		config.Version = configVersion
+	}
+	if config.Version != configVersion {
+		config.warnings = append(config.warnings, fmt.Sprintf("%s: config version %d is not supported; reading it as version %d",
+			filePath, config.Version, configVersion))
+	}
+
+	if err = validateRules(config.Rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+	// Rules expanded from finds share the position of the rule listing them
+	for i := range config.Rules {
+		config.Rules[i].position = i + 1
+	}
+	config.Rules = expandFinds(config.Rules)
+
+	source := filepath.Base(filePath)
+	if filePath == "-" {
+		source = "stdin"
+	}
+	for i := range config.Rules {
+		config.Rules[i].source = source
+		if config.Rules[i].FindRegex != "" {
+			config.Rules[i].findRe, _ = compileFindRegex(config.Rules[i].FindRegex)
+		}
+	}
+
+	// A rule's modules are relative to the config that lists them
+	if err = resolveRuleModules(config.Rules, filepath.Dir(filePath)); err != nil {
+		return nil, err
+	}
+
+	if len(config.Include) == 0 {
+		return config, nil
+	}
+	if len(stack) == maxIncludeDepth {
+		return nil, fmt.Errorf("%s: includes nest deeper than %d", filePath, maxIncludeDepth)
+	}
+
+	self, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, err
+	}
+	stack = append(slices.Clip(stack), self)
+
+	var groups [][]FindReplace
+	for _, include := range config.Include {
+		path := include
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(filePath), path)
+		}
+
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(stack, abs) {
+			return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(stack, " -> "), abs)
+		}
+
+		included, err := loadConfig(path, "", strategy, stack)
+		if err != nil {
+			return nil, err
+		}
+		config.warnings = append(config.warnings, included.warnings...)
+
+		// An included config's condition gates only its own rules
+		active, err := evalCondition(included.When, filepath.Dir(path))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if active {
+			groups = append(groups, included.Rules)
+		}
+	}
+
+	if config.includeLast {
+		groups = append([][]FindReplace{config.Rules}, groups...)
+	} else {
+		groups = append(groups, config.Rules)
+	}
+	config.Rules, err = mergeRuleGroups(groups, strategy)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+
+	return config, nil
+}
+
+// mergeRuleGroups concatenates the rules of several configs in order. When
+// configs have rules for the same module, strategy decides: last-wins keeps
+// the later config's rules, first-wins the earlier's, and error (the default)
+// fails unless the rules are identical.
+func mergeRuleGroups(groups [][]FindReplace, strategy string) ([]FindReplace, error) {
+	var merged []FindReplace
+	for _, group := range groups {
+		finds := make(map[string]bool)
+		for _, cmd := range group {
+			finds[ruleModule(cmd)] = true
+		}
+
+		switch strategy {
+		case "last-wins":
+			merged = slices.DeleteFunc(merged, func(cmd FindReplace) bool {
+				return finds[ruleModule(cmd)]
+			})
+		case "first-wins":
+			earlier := make(map[string]bool)
+			for _, cmd := range merged {
+				earlier[ruleModule(cmd)] = true
+			}
+			group = slices.DeleteFunc(slices.Clone(group), func(cmd FindReplace) bool {
+				return earlier[ruleModule(cmd)]
+			})
+		default:
+			for _, prev := range merged {
+				for _, cmd := range group {
+					if ruleModule(cmd) == ruleModule(prev) && !sameRule(cmd, prev) {
+						return nil, fmt.Errorf("%s and %s both have a rule for %s; pick one with -config-merge-strategy",
+							prev.source, cmd.source, ruleModule(cmd))
+					}
+				}
+			}
+			merged = slices.DeleteFunc(merged, func(cmd FindReplace) bool {
+				return finds[ruleModule(cmd)]
+			})
+		}
+		merged = append(merged, group...)
+	}
+	return merged, nil
+}
+
+// sameRule reports whether a and b write the same replace.
+func sameRule(a, b FindReplace) bool {
+	return a.Find == b.Find && a.FindExact == b.FindExact && a.FindRegex == b.FindRegex && a.Host == b.Host && a.Replace == b.Replace && a.Version == b.Version
+}
+
+// ruleModule returns what a rule finds: its find, the module path of its
+// findExact, its findRegex or its host.
+func ruleModule(cmd FindReplace) string {
+	if cmd.FindRegex != "" && cmd.Find == "" {
+		return cmd.FindRegex
+	}
+	if cmd.Host != "" && cmd.Find == "" {
+		return cmd.Host
+	}
+	if cmd.FindExact != "" {
+		path, _, _ := strings.Cut(cmd.FindExact, " ")
+		return path
+	}
+	return cmd.Find
+}
+
+// decodeYamlConfig decodes a YAML config in either the list or mapping form.
+func decodeYamlConfig(byteValue []byte) (*Config, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(byteValue, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	// An empty file has no document at all
+	var config Config
+	if len(doc.Content) == 0 {
+		return &config, nil
+	}
+
+	// Accept either a bare list of rules or the mapping form
+	root := doc.Content[0]
+	if root.Kind == yaml.SequenceNode {
+		err = root.Decode(&config.Rules)
+	} else {
+		err = root.Decode(&config)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Included rules are spliced in where the include key appears
+	if root.Kind == yaml.MappingNode {
+		keys := make(map[string]int)
+		for i := 0; i < len(root.Content); i += 2 {
+			keys[root.Content[i].Value] = i
+		}
+		include, hasInclude := keys["include"]
+		rules, hasRules := keys["rules"]
+		config.includeLast = hasInclude && hasRules && include > rules
+	}
+
+	return &config, nil
+}
+
+// decodeJSONConfig decodes a JSON config, either an array of rules or an
+// object in the mapping form.
+func decodeJSONConfig(byteValue []byte) (*Config, error) {
+	var config Config
+	var err error
+
+	trimmed := bytes.TrimSpace(byteValue)
+	switch {
+	case len(trimmed) == 0:
+		return &config, nil
+	case trimmed[0] == '[':
+		err = json.Unmarshal(trimmed, &config.Rules)
+	default:
+		err = json.Unmarshal(trimmed, &config)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// dedupeRules drops rules that find and replace the same as an earlier rule
+// and describes each one dropped, naming both rules by their config and
+// position in it.
+func dedupeRules(rules []FindReplace) ([]FindReplace, []string) {
+	var kept []FindReplace
+	var duplicates []string
+	type ruleKey struct{ find, findExact, findRegex, host, replace, version, modules string }
+	first := make(map[ruleKey]int)
+	for i, cmd := range rules {
+		key := ruleKey{cmd.Find, cmd.FindExact, cmd.FindRegex, cmd.Host, cmd.Replace, cmd.Version, strings.Join(cmd.Modules, "\n")}
+		if j, ok := first[key]; ok {
+			duplicates = append(duplicates, fmt.Sprintf("%s duplicates %s (%s => %s); ignoring it",
+				ruleLocation(cmd), ruleLocation(rules[j]), ruleModule(cmd), cmd.Replace))
+			continue
+		}
+		first[key] = i
+		kept = append(kept, cmd)
+	}
+	return kept, duplicates
+}
+
+// ruleLocation names a rule by its position in the config it came from.
+func ruleLocation(cmd FindReplace) string {
+	if cmd.source == "" {
+		return fmt.Sprintf("rule %d", cmd.position)
+	}
+	return fmt.Sprintf("rule %d in %s", cmd.position, cmd.source)
+}
+
+// onlyRules returns the rules for the named modules. Naming a module that no
+// rule finds is an error.
+func onlyRules(rules []FindReplace, only []string) ([]FindReplace, error) {
+	var kept []FindReplace
+	for _, cmd := range rules {
+		if matchesOnly(only, ruleModule(cmd)) {
+			kept = append(kept, cmd)
+		}
+	}
+
+	for _, pattern := range only {
+		found := slices.ContainsFunc(kept, func(cmd FindReplace) bool {
+			return matchesOnly([]string{pattern}, ruleModule(cmd))
+		})
+		if !found {
+			return nil, fmt.Errorf("no rule in the config finds %s", pattern)
+		}
+	}
+	return kept, nil
+}
+
+// resolveRuleModules makes the modules of each rule absolute, resolving
+// relative ones against dir.
+func resolveRuleModules(rules []FindReplace, dir string) error {
+	for i := range rules {
+		for j, module := range rules[i].Modules {
+			if !filepath.IsAbs(module) {
+				module = filepath.Join(dir, module)
+			}
+			abs, err := filepath.Abs(module)
+			if err != nil {
+				return err
+			}
+			rules[i].Modules[j] = abs
+		}
+	}
+	return nil
+}
+
+// rulesForModule returns the rules that apply to the module of goModPath:
+// those without modules, and those listing its directory or go.mod.
+func rulesForModule(rules []FindReplace, goModPath string) ([]FindReplace, error) {
+	goMod, err := filepath.Abs(goModPath)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(goMod)
+
+	var kept []FindReplace
+	for _, cmd := range rules {
+		if len(cmd.Modules) == 0 || slices.Contains(cmd.Modules, dir) || slices.Contains(cmd.Modules, goMod) {
+			kept = append(kept, cmd)
+		}
+	}
+	return kept, nil
+}
+
+// matchesOnly reports whether module matches one of the -only patterns, which
+// are path.Match globs such as github.com/acme/*.
+func matchesOnly(only []string, module string) bool {
+	for _, pattern := range only {
+		if ok, _ := path.Match(pattern, module); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeJSONLConfig decodes a config with one JSON rule per line, reading r a
+// line at a time. Blank lines are skipped.
+func decodeJSONLConfig(r io.Reader) (*Config, error) {
+	var config Config
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var cmd FindReplace
+		if err := json.Unmarshal(line, &cmd); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		config.Rules = append(config.Rules, cmd)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// decodeEnvConfig decodes a config of MODULE=PATH lines, as in a .env file.
+// Blank lines and lines starting with # are skipped.
+func decodeEnvConfig(r io.Reader) (*Config, error) {
+	var config Config
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.Count(line, "=") != 1 {
+			return nil, fmt.Errorf("line %d: want exactly one = in MODULE=PATH, got %q", lineNum, line)
+		}
+		find, replace, _ := strings.Cut(line, "=")
+		find, replace = strings.TrimSpace(find), strings.TrimSpace(replace)
+		if find == "" || replace == "" {
+			return nil, fmt.Errorf("line %d: want MODULE=PATH, got %q", lineNum, line)
+		}
+		config.Rules = append(config.Rules, FindReplace{Find: find, Replace: replace})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// validateRules checks that every rule says what to find in exactly one way,
+// reporting every rule that doesn't.
+func validateRules(rules []FindReplace) error {
+	var errs []error
+	for i, cmd := range rules {
+		switch {
+		case cmd.Find != "" && len(cmd.Finds) != 0:
+			errs = append(errs, fmt.Errorf("rule %d: find and finds are mutually exclusive", i+1))
+		case (cmd.Find != "" || len(cmd.Finds) != 0) && cmd.FindExact != "":
+			errs = append(errs, fmt.Errorf("rule %d: find and findExact are mutually exclusive", i+1))
+		case (cmd.Find != "" || len(cmd.Finds) != 0 || cmd.FindExact != "") && cmd.FindRegex != "":
+			errs = append(errs, fmt.Errorf("rule %d: findRegex can't be combined with find, finds or findExact", i+1))
+		case (cmd.Find != "" || len(cmd.Finds) != 0 || cmd.FindExact != "" || cmd.FindRegex != "") && cmd.Host != "":
+			errs = append(errs, fmt.Errorf("rule %d: host can't be combined with find, finds, findExact or findRegex", i+1))
+		case cmd.Find == "" && len(cmd.Finds) == 0 && cmd.FindExact == "" && cmd.FindRegex == "" && cmd.Host == "":
+			errs = append(errs, fmt.Errorf("rule %d: one of find, finds, findExact, findRegex or host is required", i+1))
+		case slices.Contains(cmd.Finds, ""):
+			errs = append(errs, fmt.Errorf("rule %d: finds must not contain an empty module", i+1))
+		case cmd.FindExact != "" && len(strings.Fields(cmd.FindExact)) != 2:
+			errs = append(errs, fmt.Errorf("rule %d: findExact %q must be a module path and version", i+1, cmd.FindExact))
+		case cmd.FindRegex != "":
+			if _, err := compileFindRegex(cmd.FindRegex); err != nil {
+				errs = append(errs, fmt.Errorf("rule %d: findRegex: %w", i+1, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// compileFindRegex compiles a findRegex so that it must match a whole module
+// path.
+func compileFindRegex(expr string) (*regexp.Regexp, error) {
+	if _, err := regexp.Compile(expr); err != nil {
+		return nil, err
+	}
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// execPrefix marks a replace that is a command printing the real target.
+const execPrefix = "exec:"
+
+// execTimeout bounds how long an exec: replace command may run.
+const execTimeout = 10 * time.Second
+
+// resolveExecTargets replaces each exec: target in replace with the trimmed
+// output of its command, run in dir. Commands only run when allowed, and each
+// runs once however many modules share it.
+func resolveExecTargets(ctx context.Context, replace []FindReplace, allow bool, dir string) error {
+	outputs := make(map[string]string)
+	for i, cmd := range replace {
+		command, ok := strings.CutPrefix(cmd.Replace, execPrefix)
+		if !ok {
+			continue
+		}
+		if !allow {
+			return fmt.Errorf("the replace for %s runs a command (%s); pass -allow-exec to allow it", cmd.Find, cmd.Replace)
+		}
+
+		if out, ok := outputs[command]; ok {
+			replace[i].Replace = out
+			continue
+		}
+
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			return fmt.Errorf("the replace for %s has no command after %s", cmd.Find, execPrefix)
+		}
+
+		runCtx, cancel := context.WithTimeout(ctx, execTimeout)
+		run := exec.CommandContext(runCtx, args[0], args[1:]...)
+		run.Dir = dir
+		run.Stderr = os.Stderr
+		out, err := run.Output()
+		cancel()
+		if err != nil {
+			return fmt.Errorf("the replace command for %s (%s): %w", cmd.Find, command, err)
+		}
+
+		target := strings.TrimSpace(string(out))
+		if target == "" {
+			return fmt.Errorf("the replace command for %s (%s) printed nothing", cmd.Find, command)
+		}
+		outputs[command] = target
+		replace[i].Replace = target
+	}
+	return nil
+}
+
+// ConfigProblems checks the config at filePath on its own, without a go.mod,
+// and describes every problem found. Relative local targets are checked
+// against the directory of the config's gomod, or the current directory.
+func ConfigProblems(filePath, ext, strategy string) []string {
+	config, err := ReadConfig(filePath, ext, strategy, nil)
+	if err != nil {
+		return strings.Split(err.Error(), "\n")
+	}
+
+	problems := config.warnings
+	_, duplicates := dedupeRules(config.Rules)
+	problems = append(problems, duplicates...)
+
+	if _, err = evalCondition(config.When, filepath.Dir(filePath)); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	base := ""
+	if config.GoMod != "" {
+		base = filepath.Dir(config.GoMod)
+		if !filepath.IsAbs(base) {
+			base = filepath.Join(filepath.Dir(filePath), base)
+		}
+	}
+
+	// exec: and templated targets are only known once a module matches, and
+	// ifExists targets may be missing
+	rules := slices.DeleteFunc(slices.Clone(config.Rules), func(cmd FindReplace) bool {
+		return strings.HasPrefix(cmd.Replace, execPrefix) || cmd.IfExists || strings.Contains(cmd.Replace, "{{")
+	})
+
+	problems = append(problems, unwritableTargets(rules)...)
+	for _, cmd := range rules {
+		// A versioned module path target isn't a directory
+		if cmd.Version != "" && !isLocalPath(cmd.Replace) {
+			continue
+		}
+
+		dir := cmd.Replace
+		if base != "" {
+			dir = resolveTarget(base, dir)
+		}
+		exists, err := dirExists(dir)
+		switch {
+		case err != nil:
+			problems = append(problems, err.Error())
+		case !exists:
+			problems = append(problems, fmt.Sprintf("%s => %s: directory %s does not exist", ruleModule(cmd), cmd.Replace, dir))
+		}
+	}
+
+	return problems
+}
+
+// expandFinds turns each rule with finds into one rule per module it finds.
+func expandFinds(rules []FindReplace) []FindReplace {
+	var expanded []FindReplace
+	for _, cmd := range rules {
+		if len(cmd.Finds) == 0 {
+			expanded = append(expanded, cmd)
+			continue
+		}
+		for _, find := range cmd.Finds {
+			single := cmd
+			single.Find, single.Finds = find, nil
+			expanded = append(expanded, single)
+		}
+	}
+	return expanded
+}
+
+// evalCondition evaluates a config "when" condition. Supported forms are
+// "env NAME=VALUE" and "exists PATH", with PATH relative to baseDir. An empty
+// condition is always true.
+func evalCondition(cond string, baseDir string) (bool, error) {
+	kind, arg, _ := strings.Cut(strings.TrimSpace(cond), " ")
+	arg = strings.TrimSpace(arg)
+
+	switch kind {
+	case "":
+		return true, nil
+	case "env":
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok || name == "" {
+			return false, fmt.Errorf("invalid condition %q: want env NAME=VALUE", cond)
+		}
+		return os.Getenv(name) == value, nil
+	case "exists":
+		if arg == "" {
+			return false, fmt.Errorf("invalid condition %q: want exists PATH", cond)
+		}
+		if !filepath.IsAbs(arg) {
+			arg = filepath.Join(baseDir, arg)
+		}
+		_, err := os.Stat(arg)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown condition %q", cond)
+	}
+}
@@ -0,0 +1,156 @@
+package modreplace
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffOp is a single line of an edit script: ' ' keeps a line, '-' removes a
+// line of the old text and '+' adds a line of the new text.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// UnifiedDiff returns a unified diff turning old into updated for the file at
+// path, with context unchanged lines around each change. It returns an empty
+// string when the texts are equal.
+func UnifiedDiff(path string, old, updated []byte, context int) string {
+	ops := diffLines(splitLines(string(old)), splitLines(string(updated)))
+
+	// Line numbers in old and new before each op
+	oldPos := make([]int, len(ops)+1)
+	newPos := make([]int, len(ops)+1)
+	for k, op := range ops {
+		oldPos[k+1], newPos[k+1] = oldPos[k], newPos[k]
+		if op.kind != '+' {
+			oldPos[k+1]++
+		}
+		if op.kind != '-' {
+			newPos[k+1]++
+		}
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		// Extend the hunk while changes are close enough to share context
+		start := max(0, i-context)
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			run := 0
+			for end+run < len(ops) && ops[end+run].kind == ' ' {
+				run++
+			}
+			if end+run == len(ops) || run > 2*context {
+				break
+			}
+			end += run
+		}
+		stop := min(len(ops), end+context)
+
+		if b.Len() == 0 {
+			fmt.Fprintf(&b, "--- a/%s\n+++ b/%s\n", path, path)
+		}
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n",
+			hunkRange(oldPos[start], oldPos[stop]), hunkRange(newPos[start], newPos[stop]))
+		for _, op := range ops[start:stop] {
+			b.WriteByte(op.kind)
+			b.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				b.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		i = stop
+	}
+
+	return b.String()
+}
+
+// hunkRange formats the lines from (exclusive) to to (inclusive) as a unified
+// diff range. An empty range names the line before it.
+func hunkRange(from, to int) string {
+	if to-from == 1 {
+		return fmt.Sprint(to)
+	}
+	if to == from {
+		return fmt.Sprintf("%d,0", from)
+	}
+	return fmt.Sprintf("%d,%d", from+1, to-from)
+}
+
+// ChangedLines returns the lines of old that updated drops and the lines it
+// adds, each in order.
+func ChangedLines(old, updated []byte) ([]string, []string) {
+	removed, added := []string{}, []string{}
+	for _, op := range diffLines(splitLines(string(old)), splitLines(string(updated))) {
+		switch op.kind {
+		case '-':
+			removed = append(removed, strings.TrimSuffix(op.line, "\n"))
+		case '+':
+			added = append(added, strings.TrimSuffix(op.line, "\n"))
+		}
+	}
+	return removed, added
+}
+
+// diffLines returns an edit script from a to b based on their longest common
+// subsequence. go.mod files are small enough that the quadratic table is fine.
+func diffLines(a, b []string) []diffOp {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+
+	return ops
+}
+
+// splitLines splits s into lines, each keeping its trailing newline.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
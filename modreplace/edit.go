@@ -0,0 +1,381 @@
+package modreplace
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+func appendModReplace(content []byte, replace []FindReplace, tmpl *template.Template, existing map[string]string, header, footer string) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(content)
+
+	// The header and footer frame the block, so an empty block has neither
+	if len(replace) != 0 && header != "" {
+		buf.WriteString(header + "\n")
+	}
+
+	// Append the new lines, carrying over comments from lines they replace
+	group := ""
+	for _, cmd := range groupReplaces(replace) {
+		if cmd.Group != group {
+			group = cmd.Group
+			buf.WriteString(groupMarker + group + "\n")
+		}
+		line, err := renderReplace(tmpl, cmd)
+		if err != nil {
+			return nil, err
+		}
+		if old, ok := existing[cmd.Find]; ok {
+			line = keepLineComment(line, stripProvenance(old))
+		}
+		buf.WriteString(withProvenance(line, cmd) + "\n")
+	}
+
+	if len(replace) != 0 && footer != "" {
+		buf.WriteString(footer + "\n")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// groupReplaces orders replace so that those without a group come first and
+// each group follows in the order it first appears, keeping rule order within
+// a group.
+func groupReplaces(replace []FindReplace) []FindReplace {
+	var groups []string
+	byGroup := make(map[string][]FindReplace)
+	for _, cmd := range replace {
+		if _, ok := byGroup[cmd.Group]; !ok && cmd.Group != "" {
+			groups = append(groups, cmd.Group)
+		}
+		byGroup[cmd.Group] = append(byGroup[cmd.Group], cmd)
+	}
+
+	grouped := byGroup[""]
+	for _, group := range groups {
+		grouped = append(grouped, byGroup[group]...)
+	}
+	return grouped
+}
+
+// updateModReplace rewrites content so that its replace directives are
+// exactly replace, in order, in a block right after the last require
+// statement, or at the end without one. A directive already present
+// for a module in replace keeps any comment the user added to it, and with
+// retainOrder it is updated in place instead of moving; other replace
+// directives are dropped. Directives for modules outside inScope are left
+// alone; a nil inScope covers every module. The block is framed by the
+// header and footer comments, when given, or the replaces updated in place
+// are when the block is empty; grouped replaces are headed by group
+// comments, and old copies of all those lines are dropped. The newlines content
+// ends with, if any, are kept exactly, and a file with CRLF line endings gets
+// them on every line.
+func updateModReplace(content []byte, replace []FindReplace, tmpl *template.Template, inScope func(module string) bool, retainOrder bool, header, footer string) ([]byte, error) {
+	// Edit with plain newlines and put the file's own line endings back last
+	crlf := bytes.Contains(content, []byte("\r\n"))
+	if crlf {
+		content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	}
+	content = flattenReplaceBlocks(content)
+
+	// Edit the body and put the original trailing newlines back afterwards
+	body := bytes.TrimRight(content, "\r\n")
+	trailing := content[len(body):]
+
+	first := make(map[string]int)
+	for i := len(replace) - 1; i >= 0; i-- {
+		first[replace[i].Find] = i
+	}
+	updated := make(map[int]bool)
+	existing := make(map[string]string)
+
+	var buf bytes.Buffer
+	// inPlace spans the replaces retainOrder updates where they are
+	inPlaceStart, inPlaceEnd := -1, -1
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// The old header, footer and group headers go with the block they framed
+		if trimmed := strings.TrimSpace(line); trimmed != "" && (trimmed == header || trimmed == footer || strings.HasPrefix(trimmed, groupMarker)) {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "replace") {
+			buf.WriteString(line + "\n")
+			continue
+		}
+
+		module := ReplaceModule(line)
+		if inScope != nil && !inScope(module) {
+			buf.WriteString(line + "\n")
+			continue
+		}
+
+		i, ok := first[module]
+		if !ok || updated[i] {
+			continue
+		}
+		if !retainOrder {
+			// The directive joins the others in the block, comment and all
+			if _, seen := existing[module]; !seen {
+				existing[module] = line
+			}
+			continue
+		}
+
+		rendered, err := renderReplace(tmpl, replace[i])
+		if err != nil {
+			return nil, err
+		}
+		if inPlaceStart < 0 {
+			inPlaceStart = buf.Len()
+		}
+		buf.WriteString(withProvenance(keepLineComment(rendered, stripProvenance(line)), replace[i]) + "\n")
+		inPlaceEnd = buf.Len()
+		updated[i] = true
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var rest []FindReplace
+	for i, cmd := range replace {
+		if !updated[i] {
+			rest = append(rest, cmd)
+		}
+	}
+
+	// Anchoring the block to the requires keeps it in place as the rest of
+	// go.mod grows
+	edited := buf.Bytes()
+
+	// With nothing left to append, the frame goes around the replaces
+	// updated in place instead, so it isn't lost
+	if len(rest) == 0 && inPlaceStart >= 0 {
+		var framed []byte
+		framed = append(framed, edited[:inPlaceStart]...)
+		if header != "" {
+			framed = append(framed, header+"\n"...)
+		}
+		framed = append(framed, edited[inPlaceStart:inPlaceEnd]...)
+		if footer != "" {
+			framed = append(framed, footer+"\n"...)
+		}
+		edited = append(framed, edited[inPlaceEnd:]...)
+	}
+	anchor := requireEnd(edited)
+	block, err := appendModReplace(nil, rest, tmpl, existing, header, footer)
+	if err != nil {
+		return nil, err
+	}
+	out := edited
+	if len(block) != 0 {
+		// A blank line sets the block off on either side, as in a formatted
+		// go.mod, however many the removed replaces left
+		before, after := bytes.TrimRight(edited[:anchor], "\n"), bytes.TrimLeft(edited[anchor:], "\n")
+		out = slices.Clip(before)
+		if len(out) != 0 {
+			out = append(out, "\n\n"...)
+		}
+		out = append(out, block...)
+		if len(after) != 0 {
+			out = append(append(out, '\n'), after...)
+		}
+	}
+	out = append(bytes.TrimRight(out, "\n"), trailing...)
+	if crlf {
+		out = bytes.ReplaceAll(out, []byte("\n"), []byte("\r\n"))
+	}
+	return out, nil
+}
+
+// requireEnd returns the offset just past the last require statement in
+// content, or len(content) when there is none.
+func requireEnd(content []byte) int {
+	end := len(content)
+	inBlock := false
+	offset := 0
+	for _, line := range bytes.SplitAfter(content, []byte("\n")) {
+		offset += len(line)
+		fields := strings.Fields(string(line))
+		switch {
+		case len(fields) == 0:
+		case inBlock:
+			if fields[0] == ")" {
+				inBlock = false
+				end = offset
+			}
+		case fields[0] == "require":
+			if len(fields) > 1 && fields[1] == "(" {
+				inBlock = true
+			} else {
+				end = offset
+			}
+		}
+	}
+	return end
+}
+
+// ReplaceModule returns the module path a replace line applies to.
+func ReplaceModule(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "replace" {
+		return ""
+	}
+	return fields[1]
+}
+
+// keepLineComment carries the trailing comment of existing over to rendered,
+// unless rendered already has a comment of its own.
+func keepLineComment(rendered, existing string) string {
+	if strings.Contains(rendered, "//") {
+		return rendered
+	}
+	_, comment, ok := strings.Cut(existing, "//")
+	if !ok {
+		return rendered
+	}
+	return rendered + " //" + comment
+}
+
+// withProvenance appends a comment naming the config cmd came from to line,
+// after any comment line already has.
+func withProvenance(line string, cmd FindReplace) string {
+	if cmd.source == "" {
+		return line
+	}
+	if strings.Contains(line, "//") {
+		return line + "; " + provenanceMarker + cmd.source + ")"
+	}
+	return line + " // " + provenanceMarker + cmd.source + ")"
+}
+
+// stripProvenance removes the provenance comment from line, leaving any other
+// comment in place.
+func stripProvenance(line string) string {
+	for _, sep := range []string{"; ", "// "} {
+		if i := strings.Index(line, sep+provenanceMarker); i >= 0 {
+			return strings.TrimRight(line[:i], " ")
+		}
+	}
+	return line
+}
+
+// parseReplaceTemplate parses text and checks that it renders a valid replace
+// directive for a sample rule.
+func parseReplaceTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("replace").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid replace template: %w", err)
+	}
+
+	sample := FindReplace{Find: "example.com/module", Replace: "../module", Desc: "sample"}
+	if _, err := renderReplace(tmpl, sample); err != nil {
+		return nil, fmt.Errorf("invalid replace template: %w", err)
+	}
+
+	return tmpl, nil
+}
+
+// renderReplace renders cmd with tmpl and ensures the result is still a
+// single replace directive.
+func renderReplace(tmpl *template.Template, cmd FindReplace) (string, error) {
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, cmd); err != nil {
+		return "", err
+	}
+
+	line := buf.String()
+	if !isReplaceDirective(line) {
+		return "", fmt.Errorf("template output %q is not a replace directive", line)
+	}
+
+	return line, nil
+}
+
+// isReplaceDirective reports whether line is a single line of the form
+// "replace old [version] => new [version]", optionally followed by a comment.
+func isReplaceDirective(line string) bool {
+	if strings.ContainsAny(line, "\r\n") {
+		return false
+	}
+	if i := strings.Index(line, "//"); i >= 0 {
+		line = line[:i]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != "replace" {
+		return false
+	}
+
+	arrow := slices.Index(fields, "=>")
+	if arrow < 0 {
+		return false
+	}
+	from, to := fields[1:arrow], fields[arrow+1:]
+
+	return len(from) >= 1 && len(from) <= 2 && len(to) >= 1 && len(to) <= 2
+}
+
+func deleteLinesWithReplace(content []byte) ([]byte, []string, error) {
+	var buf bytes.Buffer
+	var removed []string
+
+	// Scanner to read the original content
+	scanner := bufio.NewScanner(bytes.NewReader(flattenReplaceBlocks(content)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "replace") {
+			removed = append(removed, line)
+			continue
+		}
+		buf.WriteString(line + "\n")
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return buf.Bytes(), removed, nil
+}
+
+// flattenReplaceBlocks rewrites each replace ( ... ) block in content as one
+// replace directive per line, which the line based edits here understand.
+// Comments in a block are kept on their own lines, before the directive they
+// came before.
+func flattenReplaceBlocks(content []byte) []byte {
+	var buf bytes.Buffer
+	inBlock := false
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case inBlock && trimmed == ")":
+			inBlock = false
+		case inBlock && trimmed != "" && !strings.HasPrefix(trimmed, "//"):
+			buf.WriteString("replace " + strings.TrimLeft(line, " \t"))
+		case inBlock:
+			buf.WriteString(strings.TrimLeft(line, " \t"))
+		case strings.HasPrefix(trimmed, "replace") && strings.TrimSpace(strings.TrimPrefix(trimmed, "replace")) == "(":
+			inBlock = true
+		default:
+			buf.WriteString(line)
+		}
+	}
+	return buf.Bytes()
+}
+
+// isLocalPath reports whether a replace target is a filesystem path rather
+// than a module path, using the same rule as the go command.
+func isLocalPath(path string) bool {
+	return path == "." || path == ".." ||
+		strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../") ||
+		filepath.IsAbs(path)
+}
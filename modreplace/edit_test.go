@@ -0,0 +1,144 @@
+package modreplace
+
+import (
+	"strings"
+	"testing"
+	"text/template"
+)
+
+// updateTestModReplace runs updateModReplace with the default template and no
+// header or footer.
+func updateTestModReplace(t *testing.T, content string, replace []FindReplace, retainOrder bool) string {
+	t.Helper()
+	tmpl := template.Must(template.New("replace").Parse(DefaultTemplate))
+	out, err := updateModReplace([]byte(content), replace, tmpl, nil, retainOrder, "", "")
+	if err != nil {
+		t.Fatalf("updateModReplace: %v", err)
+	}
+	return string(out)
+}
+
+func TestUpdateModReplaceLineEndings(t *testing.T) {
+	const goMod = "module example.com/mymodule\n\nrequire example.com/thismodule v1.2.3\n\nreplace example.com/thismodule => ../old"
+	replace := []FindReplace{{Find: "example.com/thismodule", Replace: "../this"}}
+
+	for _, eol := range []string{"\n", "\r\n"} {
+		for _, trailing := range []string{"", eol, eol + eol} {
+			name := strings.NewReplacer("\r", `\r`, "\n", `\n`).Replace("eol " + eol + " trailing " + trailing)
+			t.Run(name, func(t *testing.T) {
+				content := strings.ReplaceAll(goMod, "\n", eol) + trailing
+				out := updateTestModReplace(t, content, replace, false)
+
+				if !strings.Contains(out, "replace example.com/thismodule => ../this") {
+					t.Errorf("replace not updated:\n%q", out)
+				}
+				body := strings.TrimRight(out, "\r\n")
+				if got := out[len(body):]; got != trailing {
+					t.Errorf("trailing newlines are %q, want %q", got, trailing)
+				}
+				lf := strings.Count(out, "\n")
+				crlf := strings.Count(out, "\r\n")
+				if eol == "\r\n" && crlf != lf {
+					t.Errorf("%d of %d lines end in CRLF:\n%q", crlf, lf, out)
+				}
+				if eol == "\n" && crlf != 0 {
+					t.Errorf("%d lines end in CRLF:\n%q", crlf, out)
+				}
+			})
+		}
+	}
+}
+
+func TestUpdateModReplaceIsIdempotent(t *testing.T) {
+	const goMod = "module example.com/mymodule\r\n\r\nrequire example.com/thismodule v1.2.3\r\n"
+	replace := []FindReplace{{Find: "example.com/thismodule", Replace: "../this"}}
+	first := updateTestModReplace(t, goMod, replace, false)
+	second := updateTestModReplace(t, first, replace, false)
+	if first != second {
+		t.Errorf("second update changed:\n%q\nto:\n%q", first, second)
+	}
+}
+
+func TestUpdateModReplaceRetainOrderFrame(t *testing.T) {
+	const goMod = "module example.com/mymodule\n\nrequire example.com/thismodule v1.2.3\n\nreplace example.com/thismodule => ../old\n\nexclude example.com/thismodule v1.3.0\n"
+	replace := []FindReplace{{Find: "example.com/thismodule", Replace: "../this"}}
+	tmpl := template.Must(template.New("replace").Parse(DefaultTemplate))
+	const header, footer = "// BEGIN goreplace", "// END goreplace"
+
+	content := []byte(goMod)
+	for run := 1; run <= 2; run++ {
+		out, err := updateModReplace(content, replace, tmpl, nil, true, header, footer)
+		if err != nil {
+			t.Fatalf("updateModReplace: %v", err)
+		}
+		want := header + "\nreplace example.com/thismodule => ../this\n" + footer + "\n"
+		if !strings.Contains(string(out), want) {
+			t.Fatalf("run %d: replace not framed in place:\n%s", run, out)
+		}
+		if strings.Count(string(out), header) != 1 || strings.Count(string(out), footer) != 1 {
+			t.Fatalf("run %d: frame repeated:\n%s", run, out)
+		}
+		content = out
+	}
+}
+
+func TestUpdateModReplaceKeepsLayout(t *testing.T) {
+	// Typical go.mod files that already have the replaces being written
+	tests := []struct {
+		name  string
+		goMod string
+	}{
+		{
+			name: "replaces at the end",
+			goMod: `module example.com/mymodule
+
+go 1.21
+
+require (
+	example.com/thatmodule v1.2.3
+	example.com/thismodule v1.2.3
+)
+
+require example.com/indirect v1.0.0 // indirect
+
+replace example.com/thatmodule => ../that
+replace example.com/thismodule => ../this
+`,
+		},
+		{
+			name: "replaces before other directives",
+			goMod: `module example.com/mymodule
+
+go 1.21
+
+require example.com/thismodule v1.2.3
+
+replace example.com/thismodule => ../this
+
+exclude example.com/thismodule v1.3.0
+`,
+		},
+		{
+			name:  "no requires",
+			goMod: "module example.com/mymodule\n\ngo 1.21\n\nreplace example.com/thismodule => ../this\n",
+		},
+	}
+	replace := []FindReplace{
+		{Find: "example.com/thatmodule", Replace: "../that"},
+		{Find: "example.com/thismodule", Replace: "../this"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var written []FindReplace
+			for _, cmd := range replace {
+				if strings.Contains(tt.goMod, "replace "+cmd.Find+" ") {
+					written = append(written, cmd)
+				}
+			}
+			if out := updateTestModReplace(t, tt.goMod, written, false); out != tt.goMod {
+				t.Errorf("the first update changed go.mod:\n%s\nto:\n%s", tt.goMod, out)
+			}
+		})
+	}
+}
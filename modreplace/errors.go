@@ -0,0 +1,40 @@
+package modreplace
+
+import (
+	"strings"
+)
+
+// ConfigError is returned by NewPlan when the config can't be read, parsed
+// or merged, its when condition is invalid, or it has no rule for a module
+// Only names.
+type ConfigError struct {
+	// Path is the config as given in Options
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string { return e.Err.Error() }
+
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+// ValidationError is returned by NewPlan when local replace targets don't
+// exist.
+type ValidationError struct {
+	// Missing lists each missing target, or the error checking it
+	Missing []string
+}
+
+func (e *ValidationError) Error() string {
+	return "replace module error(s) or missing:\n" + strings.Join(e.Missing, "\n")
+}
+
+// ModfileError is returned by NewPlan when go.mod can't be read or parsed,
+// is corrupt, or has outdated syntax under AbortOnParse.
+type ModfileError struct {
+	Path string
+	Err  error
+}
+
+func (e *ModfileError) Error() string { return e.Err.Error() }
+
+func (e *ModfileError) Unwrap() error { return e.Err }
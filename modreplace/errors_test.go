@@ -0,0 +1,104 @@
+package modreplace
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestValidationError(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	opts := writeTestModule(t, testGoMod, `{"find":"example.com/thismodule","replace":"`+missing+`"}`)
+	opts.NoValidate = false
+
+	_, err := NewPlan(opts)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("NewPlan returned %v, want a *ValidationError", err)
+	}
+	if !slices.Equal(validationErr.Missing, []string{missing}) {
+		t.Errorf("Missing is %q, want %q", validationErr.Missing, missing)
+	}
+}
+
+func TestConfigError(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		opts   func(*Options)
+	}{
+		{
+			name:   "unparsable config",
+			config: `{"find":`,
+		},
+		{
+			name:   "invalid condition",
+			config: `{"when":"sometimes","rules":[{"find":"example.com/thismodule","replace":"/tmp/this"}]}`,
+			opts:   func(o *Options) { o.ConfigExt = "json" },
+		},
+		{
+			name:   "only names a module without a rule",
+			config: `{"find":"example.com/thismodule","replace":"/tmp/this"}`,
+			opts:   func(o *Options) { o.Only = []string{"example.com/nothing"} },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := writeTestModule(t, testGoMod, tt.config)
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+
+			_, err := NewPlan(opts)
+			var configErr *ConfigError
+			if !errors.As(err, &configErr) {
+				t.Fatalf("NewPlan returned %v, want a *ConfigError", err)
+			}
+			if configErr.Path != opts.ConfigPath {
+				t.Errorf("Path is %q, want %q", configErr.Path, opts.ConfigPath)
+			}
+		})
+	}
+}
+
+func TestModfileError(t *testing.T) {
+	const config = `{"find":"example.com/thismodule","replace":"/tmp/this"}`
+	tests := []struct {
+		name  string
+		goMod string
+		opts  func(*Options)
+	}{
+		{
+			name:  "unparsable go.mod",
+			goMod: "module example.com/mymodule\n\nrequire (\n",
+		},
+		{
+			name:  "missing go.mod",
+			goMod: testGoMod,
+			opts:  func(o *Options) { o.GoModPath += ".missing" },
+		},
+		{
+			name:  "parser warning under AbortOnParse",
+			goMod: "module example.com/mymodule\n\nrequire example.com/thismodule v1.2.3\n",
+			opts:  func(o *Options) { o.AbortOnParse = true },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := writeTestModule(t, tt.goMod, config)
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+
+			_, err := NewPlan(opts)
+			var modfileErr *ModfileError
+			if !errors.As(err, &modfileErr) {
+				t.Fatalf("NewPlan returned %v, want a *ModfileError", err)
+			}
+			if modfileErr.Path != opts.GoModPath {
+				t.Errorf("Path is %q, want %q", modfileErr.Path, opts.GoModPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package modreplace
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+)
+
+// InGitRepo reports whether dir is inside a git work tree. Without git
+// installed nothing is.
+func InGitRepo(dir string) bool {
+	cmd := exec.Command("git", "rev-parse", "--is-inside-work-tree")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	return err == nil && string(bytes.TrimSpace(out)) == "true"
+}
+
+// gitDirty reports whether the file at path has uncommitted changes. Files
+// outside a git work tree are never dirty.
+func gitDirty(path string) (bool, error) {
+	dir := filepath.Dir(path)
+	if !InGitRepo(dir) {
+		return false, nil
+	}
+
+	cmd := exec.Command("git", "status", "--porcelain", "--", filepath.Base(path))
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return false, errors.New(string(bytes.TrimSpace(exitErr.Stderr)))
+		}
+		return false, err
+	}
+	return len(bytes.TrimSpace(out)) != 0, nil
+}
+
+// GitAdd stages the file at path.
+func GitAdd(path string) error {
+	cmd := exec.Command("git", "add", "--", filepath.Base(path))
+	cmd.Dir = filepath.Dir(path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git add %s: %s", path, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// gitShow returns the content of a git object named like main:go.mod, read
+// with git show so nothing is checked out.
+func gitShow(object string) ([]byte, error) {
+	out, err := exec.Command("git", "show", object).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("git show %s: %s", object, bytes.TrimSpace(exitErr.Stderr))
+		}
+		return nil, fmt.Errorf("git show %s: %w", object, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,429 @@
+package modreplace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// checkModuleDirectives refuses a go.mod with more than one module directive.
+// Such a file is corrupt, and rewriting it would only preserve the damage.
+func checkModuleDirectives(goModPath string, content []byte) error {
+	var lines []string
+	for i, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "module" {
+			lines = append(lines, fmt.Sprint(i+1))
+		}
+	}
+
+	if len(lines) > 1 {
+		return fmt.Errorf("%s has %d module directives (lines %s); fix it by hand before running goreplace",
+			goModPath, len(lines), strings.Join(lines, ", "))
+	}
+	return nil
+}
+
+// parseWarnings reports go.mod syntax the parser accepts but that go mod
+// tidy would change: modules required more than once. With modern it also
+// reports go.mod files only old go versions write, with no go directive or
+// a go version before 1.17, which are valid but legacy.
+func parseWarnings(goModPath string, content []byte, modern bool) ([]string, error) {
+	file, err := modfile.Parse(goModPath, content, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []string
+	switch {
+	case !modern:
+	case file.Go == nil:
+		msgs = append(msgs, fmt.Sprintf("%s: no go directive, so go assumes go 1.16", goModPath))
+	case semver.Compare("v"+file.Go.Version, "v1.17") < 0:
+		msgs = append(msgs, fmt.Sprintf("%s:%d: go %s predates go 1.17, which lists indirect requirements separately",
+			goModPath, file.Go.Syntax.Start.Line, file.Go.Version))
+	}
+
+	required := make(map[string]int)
+	for _, req := range file.Require {
+		if line, ok := required[req.Mod.Path]; ok {
+			msgs = append(msgs, fmt.Sprintf("%s:%d: %s is already required on line %d",
+				goModPath, req.Syntax.Start.Line, req.Mod.Path, line))
+			continue
+		}
+		required[req.Mod.Path] = req.Syntax.Start.Line
+	}
+
+	return msgs, nil
+}
+
+// checkGoDirectives makes sure updated has exactly the go and toolchain
+// directives of original, in the same order. goreplace only edits replace
+// directives, so a difference is a bug that must not reach the file.
+func checkGoDirectives(goModPath string, original, updated []byte) error {
+	before, after := goDirectives(original), goDirectives(updated)
+	if !slices.Equal(before, after) {
+		return fmt.Errorf("%s: refusing to change the go and toolchain directives from %q to %q",
+			goModPath, before, after)
+	}
+	return nil
+}
+
+// dedupeReplaces drops each replace directive in content for a module and
+// version that an earlier directive already replaces, keeping the first, and
+// returns the dropped lines.
+func dedupeReplaces(goModPath string, content []byte) ([]byte, []string, error) {
+	file, err := modfile.Parse(goModPath, content, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seen := make(map[module.Version]bool)
+	drop := make(map[int]bool)
+	for _, r := range file.Replace {
+		if seen[r.Old] {
+			drop[r.Syntax.Start.Line] = true
+		}
+		seen[r.Old] = true
+	}
+	if len(drop) == 0 {
+		return content, nil, nil
+	}
+
+	var buf bytes.Buffer
+	var dropped []string
+	for i, line := range strings.SplitAfter(string(content), "\n") {
+		if drop[i+1] {
+			dropped = append(dropped, strings.TrimSpace(line))
+			continue
+		}
+		buf.WriteString(line)
+	}
+	return buf.Bytes(), dropped, nil
+}
+
+// ensureGoDirective adds a go directive for version after the module line
+// of content, unless content already has one.
+func ensureGoDirective(content []byte, version string) []byte {
+	for _, directive := range goDirectives(content) {
+		if strings.HasPrefix(directive, "go ") {
+			return content
+		}
+	}
+
+	lines := strings.SplitAfter(string(content), "\n")
+	at := 0
+	for i, line := range lines {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "module" {
+			at = i + 1
+			break
+		}
+	}
+
+	directive := "go " + version + "\n"
+	if at > 0 {
+		if !strings.HasSuffix(lines[at-1], "\n") {
+			lines[at-1] += "\n"
+		}
+		directive = "\n" + directive
+	}
+	return []byte(strings.Join(slices.Insert(lines, at, directive), ""))
+}
+
+// goDirectives returns the go and toolchain directives in content, in order
+// and with their spacing normalized.
+func goDirectives(content []byte) []string {
+	var directives []string
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && (fields[0] == "go" || fields[0] == "toolchain") {
+			directives = append(directives, strings.Join(fields, " "))
+		}
+	}
+	return directives
+}
+
+// formatModFile rewrites content in the canonical go.mod layout: sorted
+// blocks, tab indentation and the spacing go mod tidy produces.
+func formatModFile(goModPath string, content []byte) ([]byte, error) {
+	file, err := modfile.Parse(goModPath, content, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	file.SortBlocks()
+	file.Cleanup()
+	return modfile.Format(file.Syntax), nil
+}
+
+// requiredVersions returns the version each module is required at in the
+// go.mod content read from goModPath.
+func requiredVersions(goModPath string, content []byte) (map[string]string, error) {
+	file, err := modfile.Parse(goModPath, content, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	required := make(map[string]string)
+	for _, req := range file.Require {
+		required[req.Mod.Path] = req.Mod.Version
+	}
+
+	return required, nil
+}
+
+// modulePathOf returns the module path declared by the go.mod in dir.
+func modulePathOf(dir string) (string, error) {
+	return ReadModulePath(filepath.Join(dir, "go.mod"))
+}
+
+// readGoMod reads the go.mod at goModPath, or the git object ref names
+// instead when it is set.
+func readGoMod(goModPath, ref string) ([]byte, error) {
+	if ref != "" {
+		return gitShow(ref)
+	}
+	return os.ReadFile(goModPath)
+}
+
+// ReadModulePath returns the module path declared by the go.mod at goModPath.
+func ReadModulePath(goModPath string) (string, error) {
+	content, err := os.ReadFile(goModPath)
+	if err != nil {
+		return "", err
+	}
+
+	modulePath := modfile.ModulePath(content)
+	if modulePath == "" {
+		return "", fmt.Errorf("%s has no module directive", goModPath)
+	}
+
+	return modulePath, nil
+}
+
+// versionConflicts reports replaces whose target module version is not newer
+// than the version go.mod requires, which makes the replace a no-op upgrade
+// or a downgrade.
+func versionConflicts(required map[string]string, replace []FindReplace) []string {
+	var conflicts []string
+	for _, cmd := range replace {
+		if isLocalPath(cmd.Replace) || cmd.Version == "" {
+			continue
+		}
+
+		want, ok := required[cmd.Find]
+		if !ok {
+			continue
+		}
+
+		switch c := semver.Compare(cmd.Version, want); {
+		case c == 0:
+			conflicts = append(conflicts, fmt.Sprintf("replace %s => %s %s uses the version go.mod already requires", cmd.Find, cmd.Replace, cmd.Version))
+		case c < 0:
+			conflicts = append(conflicts, fmt.Sprintf("replace %s => %s %s downgrades the required %s", cmd.Find, cmd.Replace, cmd.Version, want))
+		}
+	}
+
+	return conflicts
+}
+
+// requireLines returns a "module version" line for each require in go.mod,
+// the only statements rules are matched against.
+func requireLines(goModPath string, content []byte) ([]string, error) {
+	file, err := modfile.Parse(goModPath, content, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, req := range file.Require {
+		lines = append(lines, req.Mod.Path+" "+req.Mod.Version)
+	}
+
+	return lines, nil
+}
+
+// indirectReplaces reports replaces of modules go.mod only requires
+// indirectly, which usually means a direct dependency was meant.
+func indirectReplaces(goModPath string, content []byte, replace []FindReplace) ([]string, error) {
+	file, err := modfile.Parse(goModPath, content, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	indirect := make(map[string]bool)
+	for _, req := range file.Require {
+		indirect[req.Mod.Path] = req.Indirect
+	}
+
+	var msgs []string
+	for _, cmd := range replace {
+		if indirect[cmd.Find] {
+			msgs = append(msgs, fmt.Sprintf("replace %s => %s: %s is only an indirect dependency", cmd.Find, cmd.Replace, cmd.Find))
+		}
+	}
+	return msgs, nil
+}
+
+// moduleMismatches reports local replace targets whose go.mod declares a
+// different module than the one being replaced, which go refuses to build.
+// Targets without a go.mod are left to go to complain about.
+func moduleMismatches(goModPath string, replace []FindReplace) []string {
+	root, err := filepath.Abs(filepath.Dir(goModPath))
+	if err != nil {
+		return nil
+	}
+
+	var mismatches []string
+	for _, cmd := range replace {
+		if !isLocalPath(cmd.Replace) {
+			continue
+		}
+
+		modulePath, err := ReadModulePath(filepath.Join(resolveTarget(root, cmd.Replace), "go.mod"))
+		if err != nil || modulePath == cmd.Find {
+			continue
+		}
+		mismatches = append(mismatches, fmt.Sprintf("replace target %s for %s is module %s", cmd.Replace, cmd.Find, modulePath))
+	}
+
+	return mismatches
+}
+
+// goListModules runs go list -m all against the go.mod at goModPath, which
+// fails when the module graph doesn't resolve.
+func goListModules(ctx context.Context, goModPath string) error {
+	cmd := exec.CommandContext(ctx, "go", "list", "-m", "all")
+	cmd.Dir = filepath.Dir(goModPath)
+	// go only reads a file named go.mod, and -modfile still wants one in the
+	// module root, so any other name is listed as a copy in a module of its
+	// own
+	if filepath.Base(goModPath) != "go.mod" {
+		content, err := os.ReadFile(goModPath)
+		if err != nil {
+			return err
+		}
+		modFile, cleanup, err := tempModFile(goModPath, content)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		cmd.Dir = filepath.Dir(modFile)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("go list -m all for %s failed:\n%s", goModPath, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// tempModFile writes content to a go.mod in a new temporary directory, with
+// a copy of the go.sum next to goModPath. Relative local replace targets are
+// made absolute, so the copy resolves them from anywhere. cleanup removes the
+// directory.
+func tempModFile(goModPath string, content []byte) (modFile string, cleanup func(), err error) {
+	moduleDir, err := filepath.Abs(filepath.Dir(goModPath))
+	if err != nil {
+		return "", nil, err
+	}
+	file, err := modfile.Parse(goModPath, content, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, r := range file.Replace {
+		if isLocalPath(r.New.Path) && !filepath.IsAbs(r.New.Path) {
+			if err = file.AddReplace(r.Old.Path, r.Old.Version, resolveTarget(moduleDir, r.New.Path), ""); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	content, err = file.Format()
+	if err != nil {
+		return "", nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "goreplace-graph")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+
+	modFile = filepath.Join(dir, "go.mod")
+	if err = os.WriteFile(modFile, content, 0o644); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	// The temporary go.mod reads its sums from next to it
+	sums, err := os.ReadFile(filepath.Join(filepath.Dir(goModPath), "go.sum"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		cleanup()
+		return "", nil, err
+	}
+	if err = os.WriteFile(filepath.Join(dir, "go.sum"), sums, 0o644); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return modFile, cleanup, nil
+}
+
+// BuildWithContent runs go build ./... in the module of the go.mod at
+// goModPath as if go.mod held content, through a temporary -modfile, so
+// every local replace target is compiled together without touching go.mod.
+func BuildWithContent(ctx context.Context, goModPath string, content []byte) error {
+	modFile, cleanup, err := tempModFile(goModPath, content)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	cmd := exec.CommandContext(ctx, "go", "build", "-mod=mod", "-modfile="+modFile, "./...")
+	cmd.Dir = filepath.Dir(goModPath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("go build with the new replaces failed:\n%s", bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// TraceModFile writes the parsed structure of a go.mod to w, for seeing how
+// the parser understood a file before and after it was transformed.
+func TraceModFile(w io.Writer, label, goModPath string, content []byte) error {
+	file, err := modfile.Parse(goModPath, content, nil)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%s (%s)\n", goModPath, label)
+	if file.Module != nil {
+		fmt.Fprintf(w, "  module %s\n", file.Module.Mod.Path)
+	}
+	if file.Go != nil {
+		fmt.Fprintf(w, "  go %s\n", file.Go.Version)
+	}
+	if file.Toolchain != nil {
+		fmt.Fprintf(w, "  toolchain %s\n", file.Toolchain.Name)
+	}
+	for _, req := range file.Require {
+		indirect := ""
+		if req.Indirect {
+			indirect = " (indirect)"
+		}
+		fmt.Fprintf(w, "  require %s %s%s\n", req.Mod.Path, req.Mod.Version, indirect)
+	}
+	for _, rep := range file.Replace {
+		fmt.Fprintf(w, "  replace %s => %s\n", rep.Old, rep.New)
+	}
+
+	return nil
+}
@@ -0,0 +1,234 @@
+package modreplace
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGoListModules(t *testing.T) {
+	for _, name := range []string{"go.mod", "go.mod.test", "other.mod"} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			// A relative local replace must resolve from the go.mod's own
+			// directory even when go runs elsewhere
+			dep := filepath.Join(dir, "dep")
+			if err := os.Mkdir(dep, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dep, "go.mod"), []byte("module example.com/dep\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			goMod := "module example.com/listed\n\ngo 1.21\n\nrequire example.com/dep v1.0.0\n\nreplace example.com/dep => ./dep\n"
+			goModPath := filepath.Join(dir, name)
+			if err := os.WriteFile(goModPath, []byte(goMod), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := goListModules(context.Background(), goModPath); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestParseWarnings(t *testing.T) {
+	tests := []struct {
+		name   string
+		goMod  string
+		modern bool
+		want   int
+	}{
+		{"legacy go version", "module m\n\ngo 1.14\n", false, 0},
+		{"legacy go version when modern", "module m\n\ngo 1.14\n", true, 1},
+		{"no go directive", "module m\n", false, 0},
+		{"no go directive when modern", "module m\n", true, 1},
+		{"current go version when modern", "module m\n\ngo 1.21\n", true, 0},
+		{"duplicate require", "module m\n\ngo 1.21\n\nrequire example.com/a v1.0.0\nrequire example.com/a v1.1.0\n", false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs, err := parseWarnings("go.mod", []byte(tt.goMod), tt.modern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msgs) != tt.want {
+				t.Errorf("got warnings %q, want %d", msgs, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultipleModuleDirectives(t *testing.T) {
+	goMod, err := os.ReadFile(filepath.Join("testdata", "multiple-modules.go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := writeTestModule(t, string(goMod), `{"find":"example.com/thismodule","replace":"/tmp/this"}`)
+
+	_, err = NewPlan(opts)
+	var modfileErr *ModfileError
+	if !errors.As(err, &modfileErr) {
+		t.Fatalf("NewPlan returned %v, want a *ModfileError", err)
+	}
+	if !strings.Contains(err.Error(), "2 module directives (lines 1, 7)") {
+		t.Errorf("error doesn't name both lines: %v", err)
+	}
+}
+
+func TestFormatFile(t *testing.T) {
+	const goMod = `module example.com/mymodule
+
+go 1.21
+
+require (
+    example.com/thismodule v1.2.3
+    example.com/othermodule   v1.2.3
+)
+`
+	// This is how go mod edit -fmt, and so go mod tidy, formats the result
+	const want = `module example.com/mymodule
+
+go 1.21
+
+require (
+	example.com/othermodule v1.2.3
+	example.com/thismodule v1.2.3
+)
+
+replace example.com/thismodule => /tmp/this
+`
+	opts := writeTestModule(t, goMod, `{"find":"example.com/thismodule","replace":"/tmp/this"}`)
+	opts.FormatFile = true
+	if got := planContent(t, opts); got != want {
+		t.Errorf("formatted go.mod is:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestToolchainPreserved(t *testing.T) {
+	const goMod = `module example.com/mymodule
+
+go 1.21
+
+toolchain go1.21.5
+
+require example.com/thismodule v1.2.3
+
+replace example.com/thismodule => ../old
+`
+	tests := []struct {
+		name string
+		opts func(*Options)
+	}{
+		{"apply", nil},
+		{"clean", func(o *Options) { o.Clean = true }},
+		{"retain order", func(o *Options) { o.RetainOrder = true }},
+		{"format file", func(o *Options) { o.FormatFile = true }},
+		{"ensure go version", func(o *Options) { o.GoVersion = "1.22" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := writeTestModule(t, goMod, `{"find":"example.com/thismodule","replace":"/tmp/this"}`)
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			content := planContent(t, opts)
+			if got, want := goDirectives([]byte(content)), []string{"go 1.21", "toolchain go1.21.5"}; !slices.Equal(got, want) {
+				t.Errorf("go directives are %q, want %q:\n%s", got, want, content)
+			}
+		})
+	}
+
+	changed := strings.Replace(goMod, "toolchain go1.21.5\n", "", 1)
+	if err := checkGoDirectives("go.mod", []byte(goMod), []byte(changed)); err == nil {
+		t.Error("checkGoDirectives allowed dropping the toolchain directive")
+	}
+}
+
+func TestExcludeAndRetractUntouched(t *testing.T) {
+	goMod, err := os.ReadFile(filepath.Join("testdata", "exclude-retract.go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Everything from the first exclude on must come out byte for byte
+	_, tail, _ := strings.Cut(string(goMod), "\nexclude (")
+
+	for _, clean := range []bool{false, true} {
+		opts := writeTestModule(t, string(goMod), `{"find":"example.com/thismodule","replace":"/tmp/this"}
+{"find":"example.com/thatmodule","replace":"/tmp/that"}`)
+		opts.Clean = clean
+		content := planContent(t, opts)
+		if !strings.HasSuffix(content, "\nexclude ("+tail) {
+			t.Errorf("clean %v: exclude and retract changed:\n%s", clean, content)
+		}
+		// thatmodule is only excluded, never required, so it isn't replaced
+		if strings.Contains(content, "/tmp/that") {
+			t.Errorf("clean %v: an excluded module was replaced:\n%s", clean, content)
+		}
+	}
+}
+
+func TestIndirectRequires(t *testing.T) {
+	goMod, err := os.ReadFile(filepath.Join("testdata", "indirect.go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		module string
+		warn   bool
+	}{
+		{"example.com/thismodule", false},
+		{"example.com/indirectmodule", true},
+		// Also required directly, so not only indirect
+		{"example.com/thatmodule", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.module, func(t *testing.T) {
+			opts := writeTestModule(t, string(goMod), "")
+			writeConfig(t, opts, FindReplace{Find: tt.module, Replace: "/tmp/target"})
+			plan, err := NewPlan(opts)
+			if err != nil {
+				t.Fatalf("NewPlan: %v", err)
+			}
+			warned := slices.ContainsFunc(plan.Warnings, func(msg string) bool { return strings.Contains(msg, "only an indirect dependency") })
+			if warned != tt.warn {
+				t.Errorf("warned %v, want %v: %q", warned, tt.warn, plan.Warnings)
+			}
+
+			opts.Strict = true
+			if _, err = NewPlan(opts); (err != nil) != tt.warn {
+				t.Errorf("NewPlan under Strict returned %v, want an error %v", err, tt.warn)
+			}
+		})
+	}
+}
+
+func TestEnsureGoDirective(t *testing.T) {
+	const goMod = "module example.com/mymodule\n\nrequire example.com/thismodule v1.2.3\n"
+	tests := []struct {
+		name    string
+		goMod   string
+		version string
+		want    string
+	}{
+		{"added when missing", goMod, "1.21", "module example.com/mymodule\n\ngo 1.21\n\nrequire"},
+		{"left out without a version", goMod, "", "module example.com/mymodule\n\nrequire"},
+		{"existing kept", strings.Replace(goMod, "\n\n", "\n\ngo 1.20\n\n", 1), "1.21", "module example.com/mymodule\n\ngo 1.20\n\nrequire"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := writeTestModule(t, tt.goMod, `{"find":"example.com/thismodule","replace":"/tmp/this"}`)
+			opts.GoVersion = tt.version
+			content := planContent(t, opts)
+			if !strings.HasPrefix(content, tt.want) {
+				t.Errorf("go.mod starts:\n%s\nwant:\n%s", content, tt.want)
+			}
+			if strings.Count(content, "\ngo ") > 1 {
+				t.Errorf("more than one go directive:\n%s", content)
+			}
+		})
+	}
+}
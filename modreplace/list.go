@@ -0,0 +1,93 @@
+package modreplace
+
+import (
+	"slices"
+	"strings"
+)
+
+// ListedReplace is a replace directive found in go.mod. Managed replaces are
+// those a config rule targets; goreplace drops all others on its next run.
+type ListedReplace struct {
+	Module  string `json:"module"`
+	Target  string `json:"target"`
+	Version string `json:"version,omitempty"`
+	Managed bool   `json:"managed"`
+}
+
+// ListReplaces returns the replace directives in the go.mod at goModPath, or
+// in the git object goModRef when set.
+func ListReplaces(goModPath, goModRef, configPath, configExt, strategy string) ([]ListedReplace, error) {
+	content, err := readGoMod(goModPath, goModRef)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := ReadConfig(configPath, configExt, strategy, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	managed := make(map[string]bool)
+	for _, cmd := range config.Rules {
+		managed[ruleModule(cmd)] = true
+	}
+
+	_, lines, err := deleteLinesWithReplace(content)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := []ListedReplace{}
+	for _, line := range lines {
+		marked := strings.Contains(line, provenanceMarker)
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		arrow := slices.Index(fields, "=>")
+		if arrow < 2 || arrow == len(fields)-1 {
+			continue
+		}
+
+		r := ListedReplace{Module: fields[1], Target: fields[arrow+1], Managed: managed[fields[1]] || marked}
+		if arrow+2 < len(fields) {
+			r.Version = fields[arrow+2]
+		}
+		listed = append(listed, r)
+	}
+
+	return listed, nil
+}
+
+// UnmatchedRequires returns the modules the go.mod at goModPath, or the git
+// object goModRef when set, requires that no config rule matches, in go.mod
+// order.
+func UnmatchedRequires(goModPath, goModRef, configPath, configExt, strategy string) ([]string, error) {
+	content, err := readGoMod(goModPath, goModRef)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := ReadConfig(configPath, configExt, strategy, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	required, err := requiredVersions(goModPath, content)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := requireLines(goModPath, content)
+	if err != nil {
+		return nil, err
+	}
+
+	unmatched := []string{}
+	for _, line := range lines {
+		if !slices.ContainsFunc(config.Rules, func(cmd FindReplace) bool { return ruleMatchesLine(cmd, line, required) }) {
+			module, _, _ := strings.Cut(line, " ")
+			unmatched = append(unmatched, module)
+		}
+	}
+	return unmatched, nil
+}
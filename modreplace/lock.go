@@ -0,0 +1,123 @@
+package modreplace
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockVersion is the lockfile format version this release reads and writes.
+const lockVersion = 1
+
+// Lock records the replaces a run wrote to each go.mod, so that a later run
+// with -from-lock writes exactly the same ones without reading a config.
+type Lock struct {
+	Version int `json:"version"`
+	// Modules maps each go.mod, relative to the lockfile, to its replaces
+	Modules map[string][]LockedReplace `json:"modules"`
+}
+
+// LockedReplace is one replace directive recorded in a lockfile. Local
+// targets are kept relative to the go.mod, with Absolute noting that go.mod
+// had them absolute, so the lock works wherever the tree is checked out.
+type LockedReplace struct {
+	Module   string `json:"module"`
+	Replace  string `json:"replace"`
+	Absolute bool   `json:"absolute,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Desc     string `json:"desc,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Group    string `json:"group,omitempty"`
+}
+
+// WriteLock records the replaces of plans in a lockfile at lockPath.
+func WriteLock(lockPath string, plans []*Plan) error {
+	lock := Lock{Version: lockVersion, Modules: make(map[string][]LockedReplace)}
+	for _, plan := range plans {
+		key, err := lockKey(lockPath, plan.GoModPath)
+		if err != nil {
+			return err
+		}
+
+		locked := []LockedReplace{}
+		for _, cmd := range plan.Add {
+			replace, err := relativeTarget(filepath.Dir(plan.GoModPath), cmd.Replace)
+			if err != nil {
+				return err
+			}
+			locked = append(locked, LockedReplace{
+				Module:   cmd.Find,
+				Replace:  replace,
+				Absolute: filepath.IsAbs(cmd.Replace),
+				Version:  cmd.Version,
+				Desc:     cmd.Desc,
+				Source:   cmd.source,
+				Group:    cmd.Group,
+			})
+		}
+		lock.Modules[key] = locked
+	}
+
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(lockPath, append(data, '\n'), 0o644)
+}
+
+// lockedReplaces returns the replaces the lockfile at lockPath records for
+// the go.mod at goModPath.
+func lockedReplaces(lockPath, goModPath string) ([]FindReplace, error) {
+	data, err := os.ReadFile(lockPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var lock Lock
+	if err = json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("%s: %w", lockPath, err)
+	}
+	if lock.Version != lockVersion {
+		return nil, fmt.Errorf("%s: lockfile version %d is not supported; want %d", lockPath, lock.Version, lockVersion)
+	}
+
+	key, err := lockKey(lockPath, goModPath)
+	if err != nil {
+		return nil, err
+	}
+	locked, ok := lock.Modules[key]
+	if !ok {
+		return nil, fmt.Errorf("%s has no replaces recorded for %s", lockPath, key)
+	}
+
+	replace := make([]FindReplace, 0, len(locked))
+	for _, l := range locked {
+		target := l.Replace
+		if l.Absolute {
+			target, err = filepath.Abs(resolveTarget(filepath.Dir(goModPath), target))
+			if err != nil {
+				return nil, err
+			}
+		}
+		replace = append(replace, FindReplace{Find: l.Module, Replace: target, Version: l.Version, Desc: l.Desc, Group: l.Group, source: l.Source})
+	}
+	return replace, nil
+}
+
+// lockKey names the go.mod at goModPath in the lockfile at lockPath.
+func lockKey(lockPath, goModPath string) (string, error) {
+	lockDir, err := filepath.Abs(filepath.Dir(lockPath))
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(goModPath)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(lockDir, abs)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
@@ -0,0 +1,402 @@
+package modreplace
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// findMatches returns the highest priority rule matching each require line,
+// once per module.
+func findMatches(lines []string, find []FindReplace, required map[string]string) ([]FindReplace, error) {
+	var found []FindReplace
+	for _, line := range lines {
+		var matches []FindReplace
+		for _, cmd := range find {
+			if !ruleMatchesLine(cmd, line, required) {
+				continue
+			}
+			bound, err := bindMatch(cmd, line)
+			if err != nil {
+				return nil, err
+			}
+			matches = append(matches, bound)
+		}
+		if len(matches) == 0 {
+			continue
+		}
+
+		// When several rules match one line, the highest priority wins
+		best, err := highestPriority(line, matches)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, best)
+	}
+
+	// A substring rule can match several requires
+	seen := make(map[string]bool)
+	found = slices.DeleteFunc(found, func(cmd FindReplace) bool {
+		dup := seen[cmd.Find]
+		seen[cmd.Find] = true
+		return dup
+	})
+
+	// The block lists replaces in rule order, and a rule's in require order
+	slices.SortStableFunc(found, func(a, b FindReplace) int { return a.index - b.index })
+
+	return found, nil
+}
+
+// overMatchingRules reports rules that match more than limit require lines,
+// which usually means a find pattern is far too broad.
+func overMatchingRules(lines []string, find []FindReplace, required map[string]string, limit int) []string {
+	counts := make([]int, len(find))
+	for _, line := range lines {
+		for i, cmd := range find {
+			if ruleMatchesLine(cmd, line, required) {
+				counts[i]++
+			}
+		}
+	}
+
+	var over []string
+	for i, count := range counts {
+		if count > limit {
+			over = append(over, fmt.Sprintf("rule %d (%s) matches %d lines", i+1, ruleModule(find[i]), count))
+		}
+	}
+	return over
+}
+
+// ruleMatchesLine reports whether cmd applies to a "module version" require
+// line. Substring, regex and host rules only look at the module path. Exact rules
+// need both to match and that version to be the one go.mod requires. A
+// matching exact rule has Find set to its module path.
+func ruleMatchesLine(cmd FindReplace, line string, required map[string]string) bool {
+	module, lineVersion, _ := strings.Cut(line, " ")
+	if cmd.findRe != nil {
+		return cmd.findRe.MatchString(module)
+	}
+	if cmd.Host != "" {
+		_, ok := pathUnder(module, cmd.Host)
+		return ok
+	}
+	if cmd.FindExact == "" {
+		return strings.Contains(module, cmd.Find)
+	}
+
+	path, version, _ := strings.Cut(cmd.FindExact, " ")
+	version = strings.TrimSpace(version)
+	return required[path] == version && module == path && lineVersion == version
+}
+
+// bindMatch returns cmd as it applies to the require line it matches: a
+// regex or host rule finds the matched module, and a replace containing {{ is
+// rendered as a template with the module as .Module, the regex capture
+// groups as .Capture1, .Capture2 and so on, and the rest of the path after a
+// host as .Rest.
+func bindMatch(cmd FindReplace, line string) (FindReplace, error) {
+	module, _, _ := strings.Cut(line, " ")
+	rule := ruleModule(cmd)
+	if cmd.findRe != nil || cmd.Host != "" {
+		cmd.Find = module
+	}
+	if !strings.Contains(cmd.Replace, "{{") {
+		return cmd, nil
+	}
+
+	data := map[string]string{"Module": module}
+	if cmd.Host != "" {
+		data["Rest"], _ = pathUnder(module, cmd.Host)
+	}
+	if cmd.findRe != nil {
+		for i, capture := range cmd.findRe.FindStringSubmatch(module)[1:] {
+			data[fmt.Sprintf("Capture%d", i+1)] = capture
+		}
+	}
+	tmpl, err := template.New("replace").Option("missingkey=error").Parse(cmd.Replace)
+	if err != nil {
+		return FindReplace{}, fmt.Errorf("rule %s: replace %q: %w", rule, cmd.Replace, err)
+	}
+	var b strings.Builder
+	if err = tmpl.Execute(&b, data); err != nil {
+		return FindReplace{}, fmt.Errorf("rule %s: replace %q for %s: %w", rule, cmd.Replace, module, err)
+	}
+	cmd.Replace = b.String()
+	return cmd, nil
+}
+
+// pathUnder reports whether module is prefix or a path below it, comparing
+// whole path elements, and returns the elements after prefix.
+func pathUnder(module, prefix string) (string, bool) {
+	elems := strings.Split(module, "/")
+	prefixElems := strings.Split(strings.TrimSuffix(prefix, "/"), "/")
+	if len(prefixElems) > len(elems) || !slices.Equal(elems[:len(prefixElems)], prefixElems) {
+		return "", false
+	}
+	return strings.Join(elems[len(prefixElems):], "/"), true
+}
+
+// highestPriority picks the matching rule with the highest priority. Rules
+// that tie for highest are a conflict unless they produce the same replace.
+func highestPriority(line string, matches []FindReplace) (FindReplace, error) {
+	for i := range matches {
+		if matches[i].FindExact != "" {
+			matches[i].Find, _, _ = strings.Cut(matches[i].FindExact, " ")
+		}
+	}
+
+	best := matches[0]
+	for _, cmd := range matches[1:] {
+		if cmd.Priority > best.Priority {
+			best = cmd
+		}
+	}
+
+	// Only rules at the highest priority can conflict
+	for _, cmd := range matches {
+		if cmd.Priority == best.Priority && (cmd.Find != best.Find || cmd.Replace != best.Replace || cmd.Version != best.Version) {
+			return FindReplace{}, fmt.Errorf("rules for %s and %s both match %q with priority %d; set priority to choose one",
+				best.Find, cmd.Find, strings.TrimSpace(line), cmd.Priority)
+		}
+	}
+
+	return best, nil
+}
+
+// validateLocalReposExist checks that every local target in replace exists.
+// Relative targets are resolved against the directory of goModPath, as go
+// resolves them, not the current directory.
+func validateLocalReposExist(goModPath string, replace []FindReplace) error {
+	moduleDir, err := filepath.Abs(filepath.Dir(goModPath))
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+
+	for _, cmd := range replace {
+		// A versioned module path target isn't a directory
+		if cmd.Version != "" && !isLocalPath(cmd.Replace) {
+			continue
+		}
+
+		exists, err := dirExists(resolveTarget(moduleDir, cmd.Replace))
+		if err != nil {
+			missing = append(missing, err.Error())
+			continue
+		}
+
+		if !exists {
+			missing = append(missing, cmd.Replace)
+		}
+	}
+
+	if len(missing) != 0 {
+		return &ValidationError{Missing: missing}
+	}
+
+	return nil
+}
+
+// unwritableTargets reports replace targets that goreplace can't write as a
+// plain go.mod token, such as paths containing spaces.
+func unwritableTargets(replace []FindReplace) []string {
+	var bad []string
+	for _, cmd := range replace {
+		special := strings.Contains(cmd.Replace, "//") || strings.ContainsFunc(cmd.Replace, func(r rune) bool {
+			return unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune("\"'`", r)
+		})
+		if special {
+			bad = append(bad, fmt.Sprintf("%s => %q contains spaces or special characters; symlink it from a plain path and replace with that instead",
+				cmd.Find, cmd.Replace))
+		}
+	}
+	return bad
+}
+
+// targetsInsideModule reports local replace targets that resolve to a
+// directory inside the module rooted at the go.mod's directory. The go command
+// treats such a directory as part of the main module, unless it or a
+// directory above it holds a go.mod of its own: then it is a nested module.
+func targetsInsideModule(goModPath string, replace []FindReplace) []string {
+	root, err := filepath.Abs(filepath.Dir(goModPath))
+	if err != nil {
+		return nil
+	}
+
+	var inside []string
+	for _, cmd := range replace {
+		if !isLocalPath(cmd.Replace) {
+			continue
+		}
+
+		rel, err := filepath.Rel(root, resolveTarget(root, cmd.Replace))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || nestedModule(root, rel) {
+			continue
+		}
+		inside = append(inside, fmt.Sprintf("replace target %s for %s is inside the main module at %s", cmd.Replace, cmd.Find, root))
+	}
+
+	return inside
+}
+
+// nestedModule reports whether the directory rel, relative to the module
+// root, is in a nested module: it or a directory between it and the root has
+// a go.mod.
+func nestedModule(root, rel string) bool {
+	for dir := rel; dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(root, dir, "go.mod")); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// rebaseTarget prepends base to the target of cmd when it is a relative
+// directory, keeping the result in the ./ or ../ form go.mod requires.
+func rebaseTarget(base string, cmd FindReplace) string {
+	if filepath.IsAbs(cmd.Replace) || (cmd.Version != "" && !isLocalPath(cmd.Replace)) {
+		return cmd.Replace
+	}
+
+	target := filepath.Join(base, cmd.Replace)
+	if !isLocalPath(target) {
+		target = "." + string(filepath.Separator) + target
+	}
+	return target
+}
+
+// relativeTarget rewrites an absolute local target relative to base, in the
+// ./ or ../ form go.mod needs. Other targets are returned unchanged.
+func relativeTarget(base, target string) (string, error) {
+	if !filepath.IsAbs(target) {
+		return target, nil
+	}
+
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absBase, target)
+	if err != nil {
+		return "", fmt.Errorf("can't make replace target %s relative to %s: %w", target, base, err)
+	}
+
+	rel = filepath.ToSlash(rel)
+	if rel != "." && rel != ".." && !strings.HasPrefix(rel, "../") {
+		rel = "./" + rel
+	}
+	return rel, nil
+}
+
+// resolveTarget resolves a local replace target the way the go command does,
+// relative to moduleDir, the directory holding the go.mod.
+func resolveTarget(moduleDir, target string) string {
+	if filepath.IsAbs(target) {
+		return filepath.Clean(target)
+	}
+	return filepath.Join(moduleDir, target)
+}
+
+// targetCollisions reports local directories that more than one module is
+// replaced with. A directory holds a single module, so all but one of those
+// replaces point at the wrong module.
+func targetCollisions(goModPath string, replace []FindReplace) []string {
+	moduleDir, err := filepath.Abs(filepath.Dir(goModPath))
+	if err != nil {
+		return nil
+	}
+
+	var dirs []string
+	finds := make(map[string][]string)
+	for _, cmd := range replace {
+		if !isLocalPath(cmd.Replace) {
+			continue
+		}
+		dir := resolveTarget(moduleDir, cmd.Replace)
+		if !slices.Contains(finds[dir], cmd.Find) {
+			if finds[dir] == nil {
+				dirs = append(dirs, dir)
+			}
+			finds[dir] = append(finds[dir], cmd.Find)
+		}
+	}
+
+	var collisions []string
+	for _, dir := range dirs {
+		if len(finds[dir]) < 2 {
+			continue
+		}
+
+		// Only a directory that really is a module makes this a collision
+		modulePath, err := modulePathOf(dir)
+		if err != nil {
+			continue
+		}
+		collisions = append(collisions, fmt.Sprintf("%s all replace into %s, which holds only module %s",
+			strings.Join(finds[dir], ", "), dir, modulePath))
+	}
+
+	return collisions
+}
+
+// dirExists checks if a given path exists and is a directory.
+func dirExists(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// The path does not exist
+			return false, nil
+		}
+		// There was some other error accessing the path
+		return false, err
+	}
+	// The path exists; check if it's a directory
+	return info.IsDir(), nil
+}
+
+// explainTargets writes how the target of each local replace in plan
+// resolves: as the config gave it, after -replace-base, and the absolute path
+// both goreplace and the go command use, with what is there.
+func explainTargets(w io.Writer, plan *Plan) error {
+	moduleDir, err := filepath.Abs(filepath.Dir(plan.GoModPath))
+	if err != nil {
+		return err
+	}
+
+	for _, cmd := range plan.Add {
+		if cmd.Version != "" && !isLocalPath(cmd.Replace) {
+			continue
+		}
+
+		resolved := resolveTarget(moduleDir, cmd.Replace)
+
+		fmt.Fprintf(w, "%s: config %q, expanded %q\n", cmd.Find, cmd.configReplace, cmd.Replace)
+		fmt.Fprintf(w, "  checked %s (%s)\n", resolved, describePath(resolved))
+	}
+	return nil
+}
+
+// describePath says whether path is a directory, something else or missing.
+func describePath(path string) string {
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return "missing"
+	case err != nil:
+		return err.Error()
+	case info.IsDir():
+		return "directory"
+	default:
+		return "not a directory"
+	}
+}
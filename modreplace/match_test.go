@@ -0,0 +1,311 @@
+package modreplace
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestHighestPriority(t *testing.T) {
+	const line = "\texample.com/thismodule v1.2.3"
+	tests := []struct {
+		name    string
+		matches []FindReplace
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "single match",
+			matches: []FindReplace{{Find: "thismodule", Replace: "/a"}},
+			want:    "/a",
+		},
+		{
+			name: "higher priority wins",
+			matches: []FindReplace{
+				{Find: "thismodule", Replace: "/a"},
+				{Find: "example.com/thismodule", Replace: "/b", Priority: 1},
+			},
+			want: "/b",
+		},
+		{
+			name: "later higher priority settles an earlier tie",
+			matches: []FindReplace{
+				{Find: "thismodule", Replace: "/a"},
+				{Find: "example.com", Replace: "/b"},
+				{Find: "example.com/thismodule", Replace: "/c", Priority: 1},
+			},
+			want: "/c",
+		},
+		{
+			name: "tie at the highest priority",
+			matches: []FindReplace{
+				{Find: "example.com/thismodule", Replace: "/c", Priority: 1},
+				{Find: "thismodule", Replace: "/a", Priority: 1},
+				{Find: "example.com", Replace: "/b"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "identical rules don't conflict",
+			matches: []FindReplace{
+				{Find: "thismodule", Replace: "/a"},
+				{Find: "thismodule", Replace: "/a"},
+			},
+			want: "/a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := highestPriority(line, tt.matches)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("highestPriority picked %q, want a conflict", got.Replace)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("highestPriority: %v", err)
+			}
+			if got.Replace != tt.want {
+				t.Errorf("highestPriority picked %q, want %q", got.Replace, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetInsideModule(t *testing.T) {
+	opts := writeTestModule(t, testGoMod, "")
+	inside := filepath.Join(filepath.Dir(opts.GoModPath), "third_party", "this")
+	writeConfig(t, opts, FindReplace{Find: "example.com/thismodule", Replace: inside})
+
+	plan, err := NewPlan(opts)
+	if err != nil {
+		t.Fatalf("NewPlan: %v", err)
+	}
+	if !slices.ContainsFunc(plan.Warnings, func(msg string) bool { return strings.Contains(msg, "is inside the main module") }) {
+		t.Errorf("no warning about the target inside the module in %q", plan.Warnings)
+	}
+
+	opts.Strict = true
+	if _, err = NewPlan(opts); err == nil {
+		t.Error("NewPlan succeeded under Strict, want an error")
+	}
+}
+
+func TestFindExact(t *testing.T) {
+	const goMod = `module example.com/mymodule
+
+go 1.21
+
+require (
+	example.com/thismodule v1.2.3
+	example.com/thatmodule v1.0.0
+)
+`
+	tests := []struct {
+		name      string
+		findExact string
+		want      bool
+	}{
+		{"required version", "example.com/thismodule v1.2.3", true},
+		{"other version", "example.com/thismodule v1.3.0", false},
+		{"version of another module", "example.com/thatmodule v1.2.3", false},
+		{"path prefix", "example.com/this v1.2.3", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := writeTestModule(t, goMod, "")
+			writeConfig(t, opts, FindReplace{FindExact: tt.findExact, Replace: "/tmp/exact"})
+			content := planContent(t, opts)
+			if got := strings.Contains(content, "=> /tmp/exact"); got != tt.want {
+				t.Errorf("replaced is %v, want %v:\n%s", got, tt.want, content)
+			}
+		})
+	}
+
+	// Each version has its own rule, and only the required one applies
+	t.Run("rules for several versions", func(t *testing.T) {
+		opts := writeTestModule(t, goMod, "")
+		writeConfig(t, opts,
+			FindReplace{FindExact: "example.com/thismodule v1.0.0", Replace: "/tmp/old"},
+			FindReplace{FindExact: "example.com/thismodule v1.2.3", Replace: "/tmp/current"},
+			FindReplace{FindExact: "example.com/thismodule v2.0.0", Replace: "/tmp/new"},
+		)
+		content := planContent(t, opts)
+		if !strings.Contains(content, "replace example.com/thismodule => /tmp/current") {
+			t.Errorf("the rule for the required version wasn't applied:\n%s", content)
+		}
+		if strings.Contains(content, "/tmp/old") || strings.Contains(content, "/tmp/new") {
+			t.Errorf("a rule for another version was applied:\n%s", content)
+		}
+	})
+}
+
+func TestTargetWithSpaces(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "my checkout")
+	if err := os.Mkdir(target, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	opts := writeTestModule(t, testGoMod, "")
+	writeConfig(t, opts, FindReplace{Find: "example.com/thismodule", Replace: target})
+
+	_, err := NewPlan(opts)
+	if err == nil {
+		t.Fatal("NewPlan succeeded, want an error for the space in the target")
+	}
+	if !strings.Contains(err.Error(), "symlink") {
+		t.Errorf("error doesn't suggest a symlink: %v", err)
+	}
+}
+
+func TestIfExists(t *testing.T) {
+	present := t.TempDir()
+	absent := filepath.Join(t.TempDir(), "missing")
+	tests := []struct {
+		name   string
+		target string
+		want   bool
+	}{
+		{"present", present, true},
+		{"absent", absent, false},
+		// Relative targets are looked for next to go.mod, wherever the run is
+		{"relative present", "./present", true},
+		{"relative absent", "./missing", false},
+	}
+
+	// Only the working directory has ./missing
+	chdir(t, t.TempDir())
+	if err := os.Mkdir("missing", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := writeTestModule(t, testGoMod, "")
+			if err := os.Mkdir(filepath.Join(filepath.Dir(opts.GoModPath), "present"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			opts.NoValidate = false
+			writeConfig(t, opts, FindReplace{Find: "example.com/thismodule", Replace: tt.target, IfExists: true})
+			plan, err := NewPlan(opts)
+			if err != nil {
+				t.Fatalf("NewPlan: %v", err)
+			}
+			if got := len(plan.Add) == 1; got != tt.want {
+				t.Errorf("plan adds %v, want the rule applied %v", plan.Add, tt.want)
+			}
+			// A skipped optional target is silent
+			if !tt.want && len(plan.Warnings) != 0 {
+				t.Errorf("skipping warned: %q", plan.Warnings)
+			}
+		})
+	}
+}
+
+func TestRequireBlockMatching(t *testing.T) {
+	goMod, err := os.ReadFile(filepath.Join("testdata", "require-block.go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		find string
+		want bool
+	}{
+		// Only required module paths match, never comments or delimiters
+		{"example.com/delimited", false},
+		{"example.com/commentedmodule", false},
+		{"example.com/pinned", false},
+		{"example.com/closing", false},
+		{"example.com/mymodule", false},
+		{"example.com/required", true},
+		{"example.com/paren", true},
+		{"example.com/single", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.find, func(t *testing.T) {
+			opts := writeTestModule(t, string(goMod), "")
+			writeConfig(t, opts, FindReplace{Find: tt.find, Replace: "/tmp/target"})
+			plan, err := NewPlan(opts)
+			if err != nil {
+				t.Fatalf("NewPlan: %v", err)
+			}
+			if got := len(plan.Add) == 1; got != tt.want {
+				t.Errorf("find %q matched %v, want %v", tt.find, got, tt.want)
+			}
+		})
+	}
+}
+
+// chdir changes the working directory to dir for the rest of the test.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestWorkspaceRelativeTargets(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"a", "b", "dep"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, member := range []string{"a", "b"} {
+		goMod := "module example.com/" + member + "\n\ngo 1.21\n\nrequire example.com/dep v1.0.0\n"
+		if err := os.WriteFile(filepath.Join(root, member, "go.mod"), []byte(goMod), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "go.work"), []byte("go 1.21\n\nuse (\n\t./a\n\t./b\n)\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run from the workspace root, as goreplace -gowork go.work would be
+	chdir(t, root)
+	goModPaths, _, err := LayeredModules([]string{"go.work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target  string
+		wantErr bool
+	}{
+		// ../dep is right for every member, though not for the root
+		{"../dep", false},
+		// ./dep is only there from the root
+		{"./dep", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			opts := Options{
+				Rules:        []FindReplace{{Find: "example.com/dep", Replace: tt.target}},
+				ConfigPath:   filepath.Join(root, "missing.yaml"),
+				NoProvenance: true,
+			}
+			_, errs, err := NewPlans(opts, goModPaths, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, err := range errs {
+				var validationErr *ValidationError
+				if got := errors.As(err, &validationErr); got != tt.wantErr {
+					t.Errorf("%s: NewPlan returned %v, want a validation error %v", goModPaths[i], err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+// Package modreplace plans and writes the replace directives goreplace
+// manages in go.mod files. NewPlan computes the changes a config makes
+// without writing anything, and Apply writes a plan.
+package modreplace
+
+import (
+	"regexp"
+)
+
+// FindReplace is an object represent in a specified yaml config
+type FindReplace struct {
+	Find    string `yaml:"find" json:"find"`
+	Replace string `yaml:"replace" json:"replace"`
+	Version string `yaml:"version" json:"version"`
+	Desc    string `yaml:"desc" json:"desc"`
+	// Finds lists several modules sharing one replace, as if each had its
+	// own rule; it is expanded when the config is read
+	Finds []string `yaml:"finds" json:"finds"`
+	// FindExact matches a required "module version" pair instead of a
+	// substring, so the rule only applies to that version
+	FindExact string `yaml:"findExact" json:"findExact"`
+	// FindRegex matches module paths against a regular expression, which
+	// must match the whole path; replace may use its capture groups
+	FindRegex string `yaml:"findRegex" json:"findRegex"`
+	// Host matches every module path under a prefix such as github.com/acme,
+	// compared a path element at a time so it never matches github.com/acmetools
+	Host string `yaml:"host" json:"host"`
+	// Priority decides between rules matching the same line; higher wins
+	Priority int `yaml:"priority" json:"priority"`
+	// Modules limits the rule to these modules, given as directories or
+	// go.mod files relative to the config; empty means every module
+	Modules []string `yaml:"modules" json:"modules"`
+	// IfExists applies the rule only when its local target exists, and
+	// skips it silently otherwise
+	IfExists bool `yaml:"ifExists" json:"ifExists"`
+	// Group names a block the replace is written in, under a comment
+	// header; replaces without a group come first, with no header
+	Group string `yaml:"group" json:"group"`
+
+	// findRe is FindRegex compiled when the config is read
+	findRe *regexp.Regexp
+	// source names the config the rule came from, for the provenance comment
+	source string
+	// position is the rule's number within its source, counting from 1
+	position int
+	// configReplace is Replace as the config gave it, before any rebasing
+	configReplace string
+	// index is the rule's position in the config, which identifies it across
+	// the plans of a workspace
+	index int
+}
+
+// Config is the mapping form of a config file, used when a rule set needs
+// settings that apply to all of its rules. A plain list of rules is also
+// accepted.
+type Config struct {
+	When  string        `yaml:"when" json:"when"`
+	Rules []FindReplace `yaml:"rules" json:"rules"`
+	// Include lists other configs whose rules are spliced in, relative to
+	// this config's directory
+	Include []string `yaml:"include" json:"include"`
+	// Version is the config format version; 0 means configVersion
+	Version int `yaml:"version" json:"version"`
+	// GoMod names the go.mod the config manages, relative to the config; it
+	// is used when -gomod isn't given
+	GoMod string `yaml:"gomod" json:"gomod"`
+
+	// includeLast is set when include comes after rules in the file
+	includeLast bool
+	// warnings holds problems found while reading the config and its includes
+	warnings []string
+}
+
+// provenanceMarker starts the comment recording which config a replace came
+// from. It also marks the replace as managed by goreplace.
+const provenanceMarker = "goreplace (from "
+
+// groupMarker starts the comment heading each group of replaces.
+const groupMarker = "// goreplace group: "
+
+// DefaultTemplate renders a replace directive the same way goreplace always
+// has, with the optional target version and description appended.
+const DefaultTemplate = `replace {{.Find}} => {{.Replace}}{{with .Version}} {{.}}{{end}}{{with .Desc}} // {{.}}{{end}}`
@@ -0,0 +1,813 @@
+package modreplace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"golang.org/x/mod/modfile"
+)
+
+// Options configure a goreplace run.
+type Options struct {
+	GoModPath  string
+	ConfigPath string
+	// ConfigExt forces the config format instead of using the file extension
+	ConfigExt string
+	// Config, when set, is used instead of reading ConfigPath, and must
+	// come from ReadConfig with Rules already merged in. Runs over several
+	// go.mod files read the config once, as standard input can only be read
+	// once
+	Config *Config
+	// Rules are extra find rules that win over those of the config, which
+	// may then be missing
+	Rules []FindReplace
+	// MergeStrategy resolves rules for the same module from different
+	// configs: error (the default), last-wins or first-wins
+	MergeStrategy string
+	// Clean removes replace directives without adding any back
+	Clean bool
+	// Template renders each replace line; DefaultTemplate when empty
+	Template string
+	// TidySum drops go.sum entries for locally replaced modules on Apply
+	TidySum bool
+	// Backup and NoRename control how Apply writes files
+	Backup   bool
+	NoRename bool
+	// GoModRef, when set, is a git object such as main:go.mod to read go.mod
+	// from instead of GoModPath; such a plan must not be applied
+	GoModRef string
+	// TempDir is where atomic writes create their temp files; next to each
+	// file when empty. When it is on another device than a file, Apply
+	// rewrites the file in place instead and adds a warning to the plan
+	TempDir string
+	// KeepTemp leaves the temp file of a failed write behind for debugging
+	KeepTemp bool
+	// VerifyList runs go list -m all after Apply writes go.mod, and rolls the
+	// write back on failure when Backup is set
+	VerifyList bool
+	// FromLock writes the replaces recorded for the go.mod in this lockfile
+	// instead of those from the config
+	FromLock string
+	// AbortOnParse fails the plan on outdated go.mod syntax instead of
+	// reporting it as a warning, and also treats a go.mod written for go
+	// before 1.17 as outdated
+	AbortOnParse bool
+	// AllowModules, when set, are the module path prefixes that may be
+	// replaced, compared a path element at a time; a replace of any other
+	// module fails the plan
+	AllowModules []string
+	// NoValidate writes replaces without checking their local targets exist
+	NoValidate bool
+	// AllowExec lets rules whose replace starts with exec: run a command
+	// that prints the target
+	AllowExec bool
+	// Strict turns plan warnings into errors
+	Strict bool
+	// ForceWrite makes Apply rewrite go.mod even when nothing changed
+	ForceWrite bool
+	// StrictTargets rejects distinct modules replaced with the same module
+	// directory
+	StrictTargets bool
+	// ReplaceBase is prepended to every relative local replace target
+	ReplaceBase string
+	// Only restricts both cleaning and adding to modules matching these
+	// path.Match patterns
+	Only []string
+	// Context cancels the run; Apply never replaces a file once it is done
+	Context context.Context
+	// FormatFile rewrites the whole go.mod in canonical form, not just the
+	// replace directives
+	FormatFile bool
+	// MaxMatches fails the plan when a rule matches more lines than this;
+	// zero means no limit
+	MaxMatches int
+	// RequireClean makes Apply refuse to modify a go.mod with uncommitted
+	// changes in git
+	RequireClean bool
+	// Relative writes absolute local replace targets relative to RelativeTo,
+	// or to the go.mod's directory when RelativeTo is empty
+	Relative   bool
+	RelativeTo string
+	// NoProvenance leaves out the comment naming the config each replace
+	// came from
+	NoProvenance bool
+	// RetainOrder updates existing replace directives where they are rather
+	// than moving them into the block with the rest
+	RetainOrder bool
+	// Dedupe drops replace directives for a module and version that
+	// an earlier directive already replaces, wherever they are
+	Dedupe bool
+	// NoClean keeps the replace directives that no rule writes instead of
+	// dropping them
+	NoClean bool
+	// Explain, when set, receives how each local replace target resolves,
+	// before the targets are validated
+	Explain io.Writer
+	// GoVersion is the version of a go directive added to a go.mod that has
+	// none; no directive is added when empty
+	GoVersion string
+	// Header and Footer are comment lines framing the block of replaces
+	// goreplace appends
+	Header string
+	Footer string
+}
+
+// Plan is the set of changes a run would make to a go.mod, computed without
+// writing anything. Callers may filter Add with FilterAdd before passing the
+// plan to Apply.
+type Plan struct {
+	GoModPath string
+	// Remove holds the replace lines dropped from go.mod
+	Remove []string
+	// Add holds the replaces that will be appended to go.mod
+	Add []FindReplace
+	// Original is the go.mod content the plan was computed from
+	Original []byte
+	// Deduped holds the duplicate replace lines Dedupe drops
+	Deduped []string
+	// Warnings holds problems that don't stop the plan unless Strict is set
+	Warnings []string
+	// Timings holds how long each phase of planning and applying took
+	Timings []Timing
+
+	opts Options
+	tmpl *template.Template
+	// originalSum is the go.sum content Apply started from, when it tidied it
+	originalSum []byte
+	// written is set once Apply has changed go.mod or go.sum, until Rollback
+	// restores them
+	written bool
+	// replaces holds every replace line in Original
+	replaces []string
+	// skipped holds the ifExists rules that matched but whose target is
+	// missing
+	skipped []FindReplace
+	// rules holds the config rules the run considers, before those limited to
+	// other modules are dropped
+	rules []FindReplace
+}
+
+// Timing is the duration of one phase of a run.
+type Timing struct {
+	Phase    string
+	Duration time.Duration
+}
+
+// NewPlan reads the go.mod and config named by opts and computes the replaces
+// to remove and add.
+func NewPlan(opts Options) (*Plan, error) {
+	if opts.Template == "" {
+		opts.Template = DefaultTemplate
+	}
+
+	// Validate the replace template before doing any work
+	tmpl, err := parseReplaceTemplate(opts.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, marker := range []string{opts.Header, opts.Footer} {
+		if marker != "" && (!strings.HasPrefix(marker, "//") || strings.ContainsAny(marker, "\r\n")) {
+			return nil, fmt.Errorf("header and footer must be single // comment lines, got %q", marker)
+		}
+	}
+
+	plan := &Plan{GoModPath: opts.GoModPath, opts: opts, tmpl: tmpl}
+	lap := plan.stopwatch()
+
+	// Read the current go.mod
+	plan.Original, err = readGoMod(opts.GoModPath, opts.GoModRef)
+	if err != nil {
+		return nil, &ModfileError{Path: opts.GoModPath, Err: err}
+	}
+	if err = checkModuleDirectives(opts.GoModPath, plan.Original); err != nil {
+		return nil, &ModfileError{Path: opts.GoModPath, Err: err}
+	}
+	// Outdated syntax is only logged unless the caller wants it fatal
+	diags, err := parseWarnings(opts.GoModPath, plan.Original, opts.AbortOnParse)
+	if err != nil {
+		return nil, &ModfileError{Path: opts.GoModPath, Err: err}
+	}
+	if opts.AbortOnParse && len(diags) != 0 {
+		return nil, &ModfileError{Path: opts.GoModPath, Err: fmt.Errorf("go.mod parser warnings:\n%s", strings.Join(diags, "\n"))}
+	}
+	plan.Warnings = append(plan.Warnings, diags...)
+	if opts.Dedupe {
+		if _, plan.Deduped, err = dedupeReplaces(opts.GoModPath, plan.Original); err != nil {
+			return nil, &ModfileError{Path: opts.GoModPath, Err: err}
+		}
+	}
+
+	_, removed, err := deleteLinesWithReplace(plan.Original)
+	if err != nil {
+		return nil, err
+	}
+	plan.replaces = removed
+
+	plan.Remove = slices.DeleteFunc(slices.Clone(removed), func(line string) bool {
+		return len(opts.Only) != 0 && !matchesOnly(opts.Only, ReplaceModule(line))
+	})
+	lap("read go.mod")
+
+	// If clean, there is nothing to add back
+	if opts.Clean {
+		return plan, nil
+	}
+
+	// A lockfile fixes the replaces exactly as an earlier run wrote them, so
+	// there is nothing to match or resolve
+	if opts.FromLock != "" {
+		plan.Add, err = lockedReplaces(opts.FromLock, opts.GoModPath)
+		if err != nil {
+			return nil, err
+		}
+		if err = plan.checkAllowed(); err != nil {
+			return nil, err
+		}
+		if err = plan.settleRemoves(removed); err != nil {
+			return nil, err
+		}
+		lap("read lock")
+		return plan, nil
+	}
+
+	// Read the find replace config, unless the caller already has
+	config := opts.Config
+	if config == nil {
+		config, err = ReadConfig(opts.ConfigPath, opts.ConfigExt, opts.MergeStrategy, opts.Rules)
+		if err != nil {
+			return nil, &ConfigError{Path: opts.ConfigPath, Err: err}
+		}
+	} else {
+		// Plans may share the config, so each works on its own rules
+		shared := *config
+		shared.Rules = slices.Clone(config.Rules)
+		config = &shared
+	}
+
+	if err = plan.warn(config.warnings...); err != nil {
+		return nil, err
+	}
+
+	for i := range config.Rules {
+		config.Rules[i].index = i
+	}
+
+	// Identical rules are almost always a copy-paste mistake
+	rules, duplicates := dedupeRules(config.Rules)
+	if err = plan.warn(duplicates...); err != nil {
+		return nil, err
+	}
+
+	if len(opts.Only) != 0 {
+		rules, err = onlyRules(rules, opts.Only)
+		if err != nil {
+			return nil, &ConfigError{Path: opts.ConfigPath, Err: err}
+		}
+	}
+
+	plan.rules = rules
+
+	// Rules limited to other modules don't apply here
+	rules, err = rulesForModule(rules, opts.GoModPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// An inactive config leaves go.mod cleaned
+	active, err := evalCondition(config.When, filepath.Dir(opts.ConfigPath))
+	if err != nil {
+		return nil, &ConfigError{Path: opts.ConfigPath, Err: err}
+	}
+	lap("load config")
+	if !active {
+		return plan, nil
+	}
+
+	required, err := requiredVersions(opts.GoModPath, plan.Original)
+	if err != nil {
+		return nil, &ModfileError{Path: opts.GoModPath, Err: err}
+	}
+
+	// Rules only ever match requires, never exclude, retract or other lines
+	lines, err := requireLines(opts.GoModPath, plan.Original)
+	if err != nil {
+		return nil, &ModfileError{Path: opts.GoModPath, Err: err}
+	}
+
+	if opts.MaxMatches > 0 {
+		if over := overMatchingRules(lines, rules, required, opts.MaxMatches); len(over) != 0 {
+			return nil, fmt.Errorf("rules match more than -max-matches %d lines; tighten their find:\n%s",
+				opts.MaxMatches, strings.Join(over, "\n"))
+		}
+	}
+
+	// Scan go mod for any matching modules
+	plan.Add, err = findMatches(lines, rules, required)
+	if err != nil {
+		return nil, err
+	}
+	lap("scan")
+
+	for i := range plan.Add {
+		plan.Add[i].configReplace = plan.Add[i].Replace
+	}
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err = resolveExecTargets(ctx, plan.Add, opts.AllowExec, filepath.Dir(opts.ConfigPath)); err != nil {
+		return nil, err
+	}
+
+	// Rebase relative targets before anything looks at them
+	if opts.ReplaceBase != "" {
+		for i := range plan.Add {
+			plan.Add[i].Replace = rebaseTarget(opts.ReplaceBase, plan.Add[i])
+		}
+	}
+
+	if err = plan.checkAllowed(); err != nil {
+		return nil, err
+	}
+
+	// Optional checkouts that aren't there are skipped without a word. Like
+	// go, look for them from the go.mod's directory
+	moduleDir, err := filepath.Abs(filepath.Dir(opts.GoModPath))
+	if err != nil {
+		return nil, err
+	}
+	plan.Add = slices.DeleteFunc(plan.Add, func(cmd FindReplace) bool {
+		if !cmd.IfExists || !isLocalPath(cmd.Replace) {
+			return false
+		}
+		exists, err := dirExists(resolveTarget(moduleDir, cmd.Replace))
+		if err != nil || exists {
+			return false
+		}
+		plan.skipped = append(plan.skipped, cmd)
+		return true
+	})
+
+	// Targets with spaces would be split into several tokens in go.mod
+	if bad := unwritableTargets(plan.Add); len(bad) != 0 {
+		return nil, fmt.Errorf("replace targets can't be written to go.mod:\n%s", strings.Join(bad, "\n"))
+	}
+
+	if opts.Explain != nil {
+		if err = explainTargets(opts.Explain, plan); err != nil {
+			return nil, err
+		}
+	}
+
+	// Validate replace mods exist, unless a later step creates them
+	if !opts.NoValidate {
+		if err = validateLocalReposExist(opts.GoModPath, plan.Add); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.StrictTargets {
+		if collisions := targetCollisions(opts.GoModPath, plan.Add); len(collisions) != 0 {
+			return nil, fmt.Errorf("replace targets collide:\n%s", strings.Join(collisions, "\n"))
+		}
+	}
+
+	// Local targets inside the main module are treated as part of it
+	if err = plan.warn(targetsInsideModule(opts.GoModPath, plan.Add)...); err != nil {
+		return nil, err
+	}
+
+	// Replacing an indirect dependency rarely does what was meant
+	indirect, err := indirectReplaces(opts.GoModPath, plan.Original, plan.Add)
+	if err != nil {
+		return nil, err
+	}
+	if err = plan.warn(indirect...); err != nil {
+		return nil, err
+	}
+
+	// A target declaring another module would make go fail to build
+	if err = plan.warn(moduleMismatches(opts.GoModPath, plan.Add)...); err != nil {
+		return nil, err
+	}
+
+	// Module targets at or below the required version are likely mistakes
+	if err = plan.warn(versionConflicts(required, plan.Add)...); err != nil {
+		return nil, err
+	}
+
+	// Targets are checked in absolute form and only then made relative
+	if opts.Relative || opts.RelativeTo != "" {
+		base := opts.RelativeTo
+		if base == "" {
+			base = filepath.Dir(opts.GoModPath)
+		}
+		for i := range plan.Add {
+			plan.Add[i].Replace, err = relativeTarget(base, plan.Add[i].Replace)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if opts.NoProvenance {
+		for i := range plan.Add {
+			plan.Add[i].source = ""
+		}
+	}
+
+	if err = plan.settleRemoves(removed); err != nil {
+		return nil, err
+	}
+	lap("validate")
+
+	return plan, nil
+}
+
+// NewPlans computes a plan for each go.mod in goModPaths like NewPlan, with
+// up to concurrency of them at once. The plans and errors line up with
+// goModPaths, and explanations are written to opts.Explain in that order.
+func NewPlans(opts Options, goModPaths []string, concurrency int) ([]*Plan, []error, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	plans := make([]*Plan, len(goModPaths))
+	errs := make([]error, len(goModPaths))
+	explain := make([]bytes.Buffer, len(goModPaths))
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, path := range goModPaths {
+		opts := opts
+		opts.GoModPath = path
+		if opts.Explain != nil {
+			opts.Explain = &explain[i]
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			plans[i], errs[i] = NewPlan(opts)
+			<-sem
+		}(i)
+	}
+	wg.Wait()
+
+	// Explanations read the same however many plans ran at once
+	if opts.Explain != nil {
+		for i := range explain {
+			if _, err := explain[i].WriteTo(opts.Explain); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return plans, errs, nil
+}
+
+// checkAllowed fails when AllowModules is set and the plan adds a replace
+// for a module outside it. Governance applies however the replaces were
+// found, config or lockfile.
+func (p *Plan) checkAllowed() error {
+	if len(p.opts.AllowModules) == 0 {
+		return nil
+	}
+	var denied []string
+	for _, cmd := range p.Add {
+		allowed := slices.ContainsFunc(p.opts.AllowModules, func(prefix string) bool {
+			_, ok := pathUnder(cmd.Find, prefix)
+			return ok
+		})
+		if !allowed {
+			denied = append(denied, fmt.Sprintf("%s => %s (from %s)", cmd.Find, cmd.Replace, cmd.source))
+		}
+	}
+	if len(denied) != 0 {
+		return fmt.Errorf("replacing these modules is not allowed by -allow-module:\n%s", strings.Join(denied, "\n"))
+	}
+	return nil
+}
+
+// settleRemoves keeps the replaces that Add writes again out of Remove, as
+// they are updated in place. removed holds every replace line in go.mod.
+func (p *Plan) settleRemoves(removed []string) error {
+	// Replaces that are added back are updated in place, not removed
+	readded := make(map[string]bool)
+	for _, cmd := range p.Add {
+		readded[cmd.Find] = true
+	}
+	p.Remove = slices.DeleteFunc(p.Remove, func(line string) bool {
+		return readded[ReplaceModule(line)]
+	})
+
+	// Without cleaning, only extra copies of a replace being written go, since
+	// go rejects a go.mod that replaces a module twice
+	if p.opts.NoClean {
+		p.Remove = nil
+		seen := make(map[string]bool)
+		for _, line := range removed {
+			module := ReplaceModule(line)
+			if !readded[module] {
+				continue
+			}
+			if seen[module] {
+				p.Remove = append(p.Remove, line)
+				if err := p.warn(fmt.Sprintf("skipping duplicate replace for %s: %s", module, line)); err != nil {
+					return err
+				}
+			}
+			seen[module] = true
+		}
+	}
+	return nil
+}
+
+// FilterAdd keeps the replaces in Add that keep reports true for. The
+// directives go.mod already has for the modules it drops are then removed
+// like those of any module no rule writes, and Remove lists them.
+func (p *Plan) FilterAdd(keep func(cmd FindReplace) bool) {
+	var kept []FindReplace
+	for _, cmd := range p.Add {
+		if keep(cmd) {
+			kept = append(kept, cmd)
+			continue
+		}
+
+		// Without cleaning, the module's directives are left as they are
+		if p.opts.NoClean {
+			p.Remove = slices.DeleteFunc(p.Remove, func(line string) bool { return ReplaceModule(line) == cmd.Find })
+			continue
+		}
+		if len(p.opts.Only) != 0 && !matchesOnly(p.opts.Only, cmd.Find) {
+			continue
+		}
+		for _, line := range p.replaces {
+			if ReplaceModule(line) == cmd.Find {
+				p.Remove = append(p.Remove, line)
+			}
+		}
+	}
+	p.Add = kept
+}
+
+// stopwatch returns a function that records the time since its last call, or
+// since stopwatch was called, as the named phase.
+func (p *Plan) stopwatch() func(phase string) {
+	last := time.Now()
+	return func(phase string) {
+		now := time.Now()
+		p.Timings = append(p.Timings, Timing{Phase: phase, Duration: now.Sub(last)})
+		last = now
+	}
+}
+
+// UnusedRules describes the rules that none of plans adds a replace for.
+func UnusedRules(plans []*Plan) []string {
+	used := make(map[int]bool)
+	for _, plan := range plans {
+		for _, cmd := range plan.Add {
+			used[cmd.index] = true
+		}
+		for _, cmd := range plan.skipped {
+			used[cmd.index] = true
+		}
+	}
+
+	var unused []string
+	reported := make(map[int]bool)
+	for _, plan := range plans {
+		for _, cmd := range plan.rules {
+			if used[cmd.index] || reported[cmd.index] {
+				continue
+			}
+			reported[cmd.index] = true
+			unused = append(unused, fmt.Sprintf("rule %s => %s (from %s) matches no module", ruleModule(cmd), cmd.Replace, cmd.source))
+		}
+	}
+	return unused
+}
+
+// warn records msgs as warnings, or returns them as an error under Strict.
+func (p *Plan) warn(msgs ...string) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	if p.opts.Strict {
+		return errors.New(strings.Join(msgs, "\n"))
+	}
+	p.Warnings = append(p.Warnings, msgs...)
+	return nil
+}
+
+// Content renders the go.mod that applying the plan would produce.
+func (p *Plan) Content() ([]byte, error) {
+	var inScope func(module string) bool
+	switch {
+	case p.opts.NoClean:
+		inScope = func(module string) bool {
+			return slices.ContainsFunc(p.Add, func(cmd FindReplace) bool { return cmd.Find == module })
+		}
+	case len(p.opts.Only) != 0:
+		inScope = func(module string) bool { return matchesOnly(p.opts.Only, module) }
+	}
+
+	original := p.Original
+	if p.opts.Dedupe {
+		var err error
+		if original, _, err = dedupeReplaces(p.GoModPath, original); err != nil {
+			return nil, err
+		}
+	}
+
+	content, err := updateModReplace(original, p.Add, p.tmpl, inScope, p.opts.RetainOrder, p.opts.Header, p.opts.Footer)
+	if err != nil {
+		return nil, err
+	}
+	if p.opts.FormatFile {
+		if content, err = formatModFile(p.GoModPath, content); err != nil {
+			return nil, err
+		}
+	}
+
+	// The go version and toolchain must survive every edit untouched
+	if err = checkGoDirectives(p.GoModPath, p.Original, content); err != nil {
+		return nil, err
+	}
+
+	// Only a missing go directive is ever added, never changed
+	if p.opts.GoVersion != "" {
+		content = ensureGoDirective(content, p.opts.GoVersion)
+	}
+
+	// Whatever the line edits did, never hand out a go.mod go can't read
+	if _, err = modfile.Parse(p.GoModPath, content, nil); err != nil {
+		return nil, &ModfileError{Path: p.GoModPath, Err: fmt.Errorf("edited go.mod is invalid: %w", err)}
+	}
+	return content, nil
+}
+
+// Changed reports whether applying the plan would modify go.mod.
+func (p *Plan) Changed() (bool, error) {
+	content, err := p.Content()
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(p.Original, content), nil
+}
+
+// ReplaceChange is a replace directive that applying a plan adds, removes or
+// modifies. Before is empty for an added directive and After for a removed
+// one.
+type ReplaceChange struct {
+	Module string
+	Before string
+	After  string
+}
+
+// ReplaceChanges lists the replace directives that applying the plan would
+// change, ignoring the rest of go.mod.
+func (p *Plan) ReplaceChanges() ([]ReplaceChange, error) {
+	content, err := p.Content()
+	if err != nil {
+		return nil, err
+	}
+
+	before, modules := replaceLines(p.Original)
+	after, added := replaceLines(content)
+	for _, module := range added {
+		if _, ok := before[module]; !ok {
+			modules = append(modules, module)
+		}
+	}
+
+	var changes []ReplaceChange
+	for _, module := range modules {
+		if before[module] != after[module] {
+			changes = append(changes, ReplaceChange{Module: module, Before: before[module], After: after[module]})
+		}
+	}
+	return changes, nil
+}
+
+// replaceLines maps each module with a replace directive in content to its
+// line, and returns the modules in the order they appear.
+func replaceLines(content []byte) (map[string]string, []string) {
+	lines := make(map[string]string)
+	var modules []string
+	for _, line := range strings.Split(string(flattenReplaceBlocks(content)), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if !strings.HasPrefix(line, "replace") {
+			continue
+		}
+		module := ReplaceModule(line)
+		if _, ok := lines[module]; !ok {
+			modules = append(modules, module)
+		}
+		lines[module] = line
+	}
+	return lines, modules
+}
+
+// Apply writes the go.mod described by plan, unless it is already up to date.
+func Apply(plan *Plan) error {
+	if plan.opts.GoModRef != "" {
+		return fmt.Errorf("%s was read from git object %s and can't be written", plan.GoModPath, plan.opts.GoModRef)
+	}
+	lap := plan.stopwatch()
+	defer lap("write")
+
+	content, err := plan.Content()
+	if err != nil {
+		return err
+	}
+
+	// Skip the write when nothing changed to avoid needless churn
+	ctx := plan.opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	w := writeOptions{ctx: ctx, backup: plan.opts.Backup, noRename: plan.opts.NoRename, tempDir: plan.opts.TempDir, keepTemp: plan.opts.KeepTemp}
+	w.warn = func(msg string) { plan.Warnings = append(plan.Warnings, msg) }
+	if plan.opts.ForceWrite || !bytes.Equal(plan.Original, content) {
+		// Don't stomp on manual edits that haven't been committed yet
+		if plan.opts.RequireClean {
+			dirty, err := gitDirty(plan.GoModPath)
+			if err != nil {
+				return err
+			}
+			if dirty {
+				return fmt.Errorf("%s has uncommitted changes; commit or stash them first", plan.GoModPath)
+			}
+		}
+		if err = w.write(plan.GoModPath, content); err != nil {
+			return err
+		}
+		plan.written = true
+	}
+
+	// Local replaces don't need sums, so stale entries only cause confusion
+	if plan.opts.TidySum {
+		goSumPath := filepath.Join(filepath.Dir(plan.GoModPath), "go.sum")
+		original, err := tidyGoSum(goSumPath, plan.Add, w)
+		if original != nil {
+			plan.originalSum, plan.written = original, true
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Broken targets show up as soon as go resolves the module graph
+	if plan.opts.VerifyList {
+		if err = goListModules(ctx, plan.GoModPath); err != nil {
+			if !plan.opts.Backup {
+				return err
+			}
+			if rerr := Rollback(plan); rerr != nil {
+				return fmt.Errorf("%w; restoring %s also failed: %v", err, plan.GoModPath, rerr)
+			}
+			return fmt.Errorf("%w; restored %s", err, plan.GoModPath)
+		}
+	}
+
+	return nil
+}
+
+// Written reports whether Apply changed any file of plan that Rollback has
+// not restored since.
+func (p *Plan) Written() bool { return p.written }
+
+// Rollback restores the go.mod, and go.sum if Apply tidied it, that plan was
+// computed from. It does nothing when Apply wrote nothing, which includes an
+// Apply that failed before writing.
+func Rollback(plan *Plan) error {
+	if !plan.written {
+		return nil
+	}
+	w := writeOptions{ctx: context.Background(), tempDir: plan.opts.TempDir, keepTemp: plan.opts.KeepTemp}
+	if err := w.write(plan.GoModPath, plan.Original); err != nil {
+		return err
+	}
+	if plan.originalSum != nil {
+		goSumPath := filepath.Join(filepath.Dir(plan.GoModPath), "go.sum")
+		if err := w.write(goSumPath, plan.originalSum); err != nil {
+			return err
+		}
+	}
+	plan.written = false
+	return nil
+}
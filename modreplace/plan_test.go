@@ -0,0 +1,727 @@
+package modreplace
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testGoMod = `module example.com/mymodule
+
+go 1.17
+
+require (
+	example.com/othermodule v1.2.3
+	example.com/thismodule v1.2.3
+	example.com/thatmodule v1.2.3
+)
+
+replace example.com/thatmodule => ../thatmodule
+`
+
+// writeTestModule writes goMod and a config.jsonl with config to a temp
+// directory and returns options naming both.
+func writeTestModule(t *testing.T, goMod, config string) Options {
+	t.Helper()
+	dir := t.TempDir()
+	goModPath := filepath.Join(dir, "go.mod")
+	configPath := filepath.Join(dir, "config.jsonl")
+	if err := os.WriteFile(goModPath, []byte(goMod), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(configPath, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return Options{GoModPath: goModPath, ConfigPath: configPath, NoValidate: true, NoProvenance: true}
+}
+
+// planContent runs NewPlan and Content, failing the test on any error.
+func planContent(t *testing.T, opts Options) string {
+	t.Helper()
+	plan, err := NewPlan(opts)
+	if err != nil {
+		t.Fatalf("NewPlan: %v", err)
+	}
+	content, err := plan.Content()
+	if err != nil {
+		t.Fatalf("Content: %v", err)
+	}
+	return string(content)
+}
+
+func TestNewPlan(t *testing.T) {
+	tests := []struct {
+		name   string
+		goMod  string
+		config string
+		opts   func(*Options)
+		// want and notWant are lines the content must and must not have
+		want    []string
+		notWant []string
+		add     int
+		remove  int
+	}{
+		{
+			name:   "replaces matching requires",
+			goMod:  testGoMod,
+			config: `{"find":"example.com/thismodule","replace":"/tmp/this"}`,
+			want:   []string{"replace example.com/thismodule => /tmp/this"},
+			// The stale replace no rule writes is cleaned
+			notWant: []string{"replace example.com/thatmodule => ../thatmodule"},
+			add:     1,
+			remove:  1,
+		},
+		{
+			name:   "skips rules that match no require",
+			goMod:  testGoMod,
+			config: `{"find":"example.com/missing","replace":"/tmp/missing"}`,
+			notWant: []string{
+				"example.com/missing",
+				"replace example.com/thatmodule => ../thatmodule",
+			},
+			remove: 1,
+		},
+		{
+			name:  "writes a versioned replace",
+			goMod: testGoMod,
+			config: `{"find":"example.com/othermodule","replace":"example.com/fork","version":"v1.3.0"}
+{"find":"example.com/thatmodule","replace":"/tmp/that"}`,
+			want: []string{
+				"replace example.com/othermodule => example.com/fork v1.3.0",
+				"replace example.com/thatmodule => /tmp/that",
+			},
+			// Rewriting the replace of thatmodule doesn't count as a remove
+			add: 2,
+		},
+		{
+			name:    "clean drops every replace",
+			goMod:   testGoMod,
+			config:  `{"find":"example.com/thismodule","replace":"/tmp/this"}`,
+			opts:    func(o *Options) { o.Clean = true },
+			notWant: []string{"replace "},
+			remove:  1,
+		},
+		{
+			name:   "no-clean keeps unmanaged replaces",
+			goMod:  testGoMod,
+			config: `{"find":"example.com/thismodule","replace":"/tmp/this"}`,
+			opts:   func(o *Options) { o.NoClean = true },
+			want: []string{
+				"replace example.com/thatmodule => ../thatmodule",
+				"replace example.com/thismodule => /tmp/this",
+			},
+			add: 1,
+		},
+		{
+			name:   "custom template",
+			goMod:  testGoMod,
+			config: `{"find":"example.com/thismodule","replace":"/tmp/this"}`,
+			opts:   func(o *Options) { o.Template = "replace {{.Find}} => {{.Replace}} // local" },
+			want:   []string{"replace example.com/thismodule => /tmp/this // local"},
+			add:    1,
+			remove: 1,
+		},
+		{
+			name:   "command line rules win over the config",
+			goMod:  testGoMod,
+			config: `{"find":"example.com/thismodule","replace":"/tmp/this"}`,
+			opts: func(o *Options) {
+				o.Rules = []FindReplace{{Find: "example.com/thismodule", Replace: "/tmp/cli"}}
+			},
+			want:    []string{"replace example.com/thismodule => /tmp/cli"},
+			notWant: []string{"/tmp/this"},
+			add:     1,
+			remove:  1,
+		},
+		{
+			name:   "only limits the modules touched",
+			goMod:  testGoMod,
+			config: `{"find":"example.com/thismodule","replace":"/tmp/this"}`,
+			opts:   func(o *Options) { o.Only = []string{"example.com/thismodule"} },
+			want: []string{
+				"replace example.com/thatmodule => ../thatmodule",
+				"replace example.com/thismodule => /tmp/this",
+			},
+			add: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := writeTestModule(t, tt.goMod, tt.config)
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			plan, err := NewPlan(opts)
+			if err != nil {
+				t.Fatalf("NewPlan: %v", err)
+			}
+			if len(plan.Add) != tt.add || len(plan.Remove) != tt.remove {
+				t.Errorf("plan adds %d and removes %d, want %d and %d", len(plan.Add), len(plan.Remove), tt.add, tt.remove)
+			}
+			content, err := plan.Content()
+			if err != nil {
+				t.Fatalf("Content: %v", err)
+			}
+			for _, line := range tt.want {
+				if !strings.Contains(string(content), line) {
+					t.Errorf("content lacks %q:\n%s", line, content)
+				}
+			}
+			for _, line := range tt.notWant {
+				if strings.Contains(string(content), line) {
+					t.Errorf("content has %q:\n%s", line, content)
+				}
+			}
+		})
+	}
+}
+
+func TestNewPlanErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		opts   func(*Options)
+	}{
+		{
+			name:   "invalid template",
+			config: `{"find":"example.com/thismodule","replace":"/tmp/this"}`,
+			opts:   func(o *Options) { o.Template = "{{.Module" },
+		},
+		{
+			name:   "missing go.mod",
+			config: `{"find":"example.com/thismodule","replace":"/tmp/this"}`,
+			opts:   func(o *Options) { o.GoModPath += ".missing" },
+		},
+		{
+			name:   "rule without find",
+			config: `{"replace":"/tmp/this"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := writeTestModule(t, testGoMod, tt.config)
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			if _, err := NewPlan(opts); err == nil {
+				t.Fatal("NewPlan succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestContentIsStable(t *testing.T) {
+	opts := writeTestModule(t, testGoMod, `{"find":"example.com/thismodule","replace":"/tmp/this"}`)
+	first := planContent(t, opts)
+	if err := os.WriteFile(opts.GoModPath, []byte(first), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if second := planContent(t, opts); second != first {
+		t.Errorf("reapplying changed go.mod:\n%s\nthen:\n%s", first, second)
+	}
+}
+
+func TestRollbackAfterFailedApply(t *testing.T) {
+	// go list fails on a local target without a go.mod, after Apply has
+	// already written go.mod
+	target := t.TempDir()
+	opts := writeTestModule(t, testGoMod, `{"find":"example.com/thismodule","replace":"`+target+`"}`)
+	opts.VerifyList = true
+	plan, err := NewPlan(opts)
+	if err != nil {
+		t.Fatalf("NewPlan: %v", err)
+	}
+	if err = Apply(plan); err == nil {
+		t.Fatal("Apply succeeded, want the go list failure")
+	}
+	if !plan.Written() {
+		t.Fatal("Apply failed after writing go.mod, but Written is false")
+	}
+
+	if err = Rollback(plan); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	content, err := os.ReadFile(opts.GoModPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != testGoMod {
+		t.Errorf("Rollback left:\n%s", content)
+	}
+	if plan.Written() {
+		t.Error("Written is still true after Rollback")
+	}
+}
+
+func TestRollbackWithoutWrite(t *testing.T) {
+	opts := writeTestModule(t, testGoMod, `{"find":"example.com/thismodule","replace":"/tmp/this"}`)
+	plan, err := NewPlan(opts)
+	if err != nil {
+		t.Fatalf("NewPlan: %v", err)
+	}
+	// A manual edit after planning must survive rolling back an unapplied plan
+	edited := testGoMod + "// edited\n"
+	if err = os.WriteFile(opts.GoModPath, []byte(edited), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err = Rollback(plan); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	content, err := os.ReadFile(opts.GoModPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != edited {
+		t.Errorf("Rollback of an unapplied plan rewrote go.mod:\n%s", content)
+	}
+}
+
+func TestTidySumWritten(t *testing.T) {
+	const sum = "example.com/othermodule v1.2.3 h1:other=\n"
+	tests := []struct {
+		name string
+		// goSum is the go.sum content, or "" for none
+		goSum string
+		want  bool
+	}{
+		{"no go.sum", "", false},
+		{"nothing to drop", sum, false},
+		{"entries dropped", sum + "example.com/thismodule v1.2.3 h1:this=\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := writeTestModule(t, testGoMod, `{"find":"example.com/thismodule","replace":"/tmp/this"}`)
+			opts.TidySum = true
+			// go.mod is already up to date, so only go.sum could change
+			if err := os.WriteFile(opts.GoModPath, []byte(planContent(t, opts)), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			goSumPath := filepath.Join(filepath.Dir(opts.GoModPath), "go.sum")
+			if tt.goSum != "" {
+				if err := os.WriteFile(goSumPath, []byte(tt.goSum), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			plan, err := NewPlan(opts)
+			if err != nil {
+				t.Fatalf("NewPlan: %v", err)
+			}
+			if err = Apply(plan); err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			if plan.Written() != tt.want {
+				t.Fatalf("Written is %v, want %v", plan.Written(), tt.want)
+			}
+			if !tt.want {
+				return
+			}
+
+			if err = Rollback(plan); err != nil {
+				t.Fatalf("Rollback: %v", err)
+			}
+			content, err := os.ReadFile(goSumPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != tt.goSum {
+				t.Errorf("Rollback left go.sum:\n%s", content)
+			}
+		})
+	}
+}
+
+func TestFilterAdd(t *testing.T) {
+	const existing = "replace example.com/thatmodule => ../thatmodule"
+	tests := []struct {
+		name    string
+		noClean bool
+		// removed is whether the declined module's directive goes
+		removed bool
+	}{
+		{"cleaning", false, true},
+		{"no-clean", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := writeTestModule(t, testGoMod, "")
+			opts.NoClean = tt.noClean
+			writeConfig(t, opts,
+				FindReplace{Find: "example.com/thismodule", Replace: "/tmp/this"},
+				FindReplace{Find: "example.com/thatmodule", Replace: "/tmp/that"},
+			)
+			plan, err := NewPlan(opts)
+			if err != nil {
+				t.Fatalf("NewPlan: %v", err)
+			}
+
+			plan.FilterAdd(func(cmd FindReplace) bool { return cmd.Find != "example.com/thatmodule" })
+			if len(plan.Add) != 1 || plan.Add[0].Find != "example.com/thismodule" {
+				t.Errorf("plan adds %v, want only thismodule", plan.Add)
+			}
+			if got := slices.Contains(plan.Remove, existing); got != tt.removed {
+				t.Errorf("Remove is %q, want the declined directive listed %v", plan.Remove, tt.removed)
+			}
+			content, err := plan.Content()
+			if err != nil {
+				t.Fatalf("Content: %v", err)
+			}
+			if got := !strings.Contains(string(content), existing); got != tt.removed {
+				t.Errorf("declined directive removed is %v, want %v:\n%s", got, tt.removed, content)
+			}
+		})
+	}
+}
+
+func TestDuplicateRuleLocation(t *testing.T) {
+	opts := writeTestModule(t, testGoMod, "")
+	dir := filepath.Dir(opts.GoModPath)
+	// The included rules come after the config's own, so their positions in
+	// the merged rules differ from those in team.yaml
+	const config = `rules:
+  - {find: example.com/othermodule, replace: /tmp/other}
+  - {find: example.com/thatmodule, replace: /tmp/that}
+include: [team.yaml]
+`
+	const team = `- {find: example.com/thismodule, replace: /tmp/this}
+- {find: example.com/thismodule, replace: /tmp/this}
+`
+	opts.ConfigPath = filepath.Join(dir, "replace.yaml")
+	for path, content := range map[string]string{opts.ConfigPath: config, filepath.Join(dir, "team.yaml"): team} {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plan, err := NewPlan(opts)
+	if err != nil {
+		t.Fatalf("NewPlan: %v", err)
+	}
+	const want = "rule 2 in team.yaml duplicates rule 1 in team.yaml"
+	if !slices.ContainsFunc(plan.Warnings, func(msg string) bool { return strings.HasPrefix(msg, want) }) {
+		t.Errorf("no warning starting %q in %q", want, plan.Warnings)
+	}
+}
+
+func TestBlockReplaces(t *testing.T) {
+	const goMod = `module example.com/mymodule
+
+go 1.17
+
+require (
+	example.com/othermodule v1.2.3
+	example.com/thismodule v1.2.3
+)
+
+replace (
+	// the fork has our fix
+	example.com/othermodule => example.com/fork v1.3.0
+	example.com/thismodule => ../old // keep me
+)
+`
+	opts := writeTestModule(t, goMod, `{"find":"example.com/thismodule","replace":"/tmp/this"}`)
+	opts.Only = []string{"example.com/thismodule"}
+	content := planContent(t, opts)
+
+	for _, line := range []string{
+		"// the fork has our fix",
+		"replace example.com/othermodule => example.com/fork v1.3.0",
+		"replace example.com/thismodule => /tmp/this // keep me",
+	} {
+		if !strings.Contains(content, line) {
+			t.Errorf("content lacks %q:\n%s", line, content)
+		}
+	}
+	if strings.Contains(content, "../old") || strings.Contains(content, "replace (") {
+		t.Errorf("block not rewritten:\n%s", content)
+	}
+}
+
+func TestCommentSurvivesReapply(t *testing.T) {
+	const goMod = `module example.com/mymodule
+
+go 1.17
+
+// pinned for the release
+require example.com/thismodule v1.2.3
+
+replace example.com/thismodule => ../old // local checkout
+`
+	opts := writeTestModule(t, goMod, `{"find":"example.com/thismodule","replace":"/tmp/this"}`)
+	opts.NoProvenance = false
+	for run := 1; run <= 2; run++ {
+		content := planContent(t, opts)
+		for _, line := range []string{
+			"// pinned for the release",
+			"replace example.com/thismodule => /tmp/this // local checkout",
+		} {
+			if !strings.Contains(content, line) {
+				t.Fatalf("run %d: content lacks %q:\n%s", run, line, content)
+			}
+		}
+		if err := os.WriteFile(opts.GoModPath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAllowModules(t *testing.T) {
+	const goMod = `module example.com/mymodule
+
+go 1.17
+
+require (
+	github.com/acme/lib v1.0.0
+	github.com/acmetools/cli v1.0.0
+)
+`
+	tests := []struct {
+		name    string
+		config  string
+		allow   []string
+		wantErr bool
+	}{
+		{
+			name:   "module below the prefix",
+			config: `{"find":"github.com/acme/lib","replace":"/tmp/lib"}`,
+			allow:  []string{"github.com/acme"},
+		},
+		{
+			name:   "module equal to the prefix",
+			config: `{"find":"github.com/acme/lib","replace":"/tmp/lib"}`,
+			allow:  []string{"github.com/acme/lib"},
+		},
+		{
+			name:    "prefix of a path element",
+			config:  `{"find":"github.com/acmetools/cli","replace":"/tmp/cli"}`,
+			allow:   []string{"github.com/acme"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := writeTestModule(t, goMod, tt.config)
+			opts.AllowModules = tt.allow
+			_, err := NewPlan(opts)
+			if tt.wantErr != (err != nil) {
+				t.Errorf("NewPlan returned %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("from lock", func(t *testing.T) {
+		opts := writeTestModule(t, goMod, `{"find":"github.com/acmetools/cli","replace":"/tmp/cli"}`)
+		plan, err := NewPlan(opts)
+		if err != nil {
+			t.Fatalf("NewPlan: %v", err)
+		}
+		lockPath := filepath.Join(filepath.Dir(opts.GoModPath), "goreplace.lock")
+		if err = WriteLock(lockPath, []*Plan{plan}); err != nil {
+			t.Fatalf("WriteLock: %v", err)
+		}
+
+		opts.FromLock = lockPath
+		opts.AllowModules = []string{"github.com/acme"}
+		if _, err = NewPlan(opts); err == nil {
+			t.Error("NewPlan from a lockfile allowed github.com/acmetools/cli")
+		}
+	})
+}
+
+// writeConfig replaces the config of opts with rules, one per line.
+func writeConfig(t *testing.T, opts Options, rules ...FindReplace) {
+	t.Helper()
+	var b strings.Builder
+	for _, rule := range rules {
+		line, err := json.Marshal(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	if err := os.WriteFile(opts.ConfigPath, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlockPlacementIsStable(t *testing.T) {
+	const goMod = `module example.com/mymodule
+
+go 1.21
+
+require (
+	example.com/thismodule v1.2.3
+	example.com/thatmodule v1.2.3
+)
+
+exclude example.com/thismodule v1.3.0
+`
+	opts := writeTestModule(t, goMod, `{"find":"example.com/thismodule","replace":"/tmp/this"}`)
+	content := planContent(t, opts)
+	const block = ")\n\nreplace example.com/thismodule => /tmp/this\n\nexclude"
+	if !strings.Contains(content, block) {
+		t.Fatalf("block isn't right after the requires:\n%s", content)
+	}
+
+	// Growing the file and changing the rules mustn't move the block
+	content += "\nretract v1.0.0\n"
+	if err := os.WriteFile(opts.GoModPath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	writeConfig(t, opts,
+		FindReplace{Find: "example.com/thismodule", Replace: "/tmp/this"},
+		FindReplace{Find: "example.com/thatmodule", Replace: "/tmp/that"},
+	)
+	content = planContent(t, opts)
+	const grown = ")\n\nreplace example.com/thismodule => /tmp/this\nreplace example.com/thatmodule => /tmp/that\n\nexclude"
+	if !strings.Contains(content, grown) || !strings.HasSuffix(content, "\nretract v1.0.0\n") {
+		t.Errorf("block moved on reapply:\n%s", content)
+	}
+}
+
+func TestBlockInRuleOrder(t *testing.T) {
+	// testGoMod requires othermodule before thismodule
+	opts := writeTestModule(t, testGoMod, "")
+	writeConfig(t, opts,
+		FindReplace{Find: "example.com/thismodule", Replace: "/tmp/this"},
+		FindReplace{Find: "example.com/othermodule", Replace: "/tmp/other"},
+	)
+	content := planContent(t, opts)
+	const block = "replace example.com/thismodule => /tmp/this\nreplace example.com/othermodule => /tmp/other\n"
+	if !strings.Contains(content, block) {
+		t.Errorf("replaces aren't in rule order:\n%s", content)
+	}
+}
+
+func TestNestedSubmodule(t *testing.T) {
+	const goMod = `module example.com/root
+
+go 1.21
+
+require example.com/root/sub v0.0.0
+`
+	opts := writeTestModule(t, goMod, "")
+	root := filepath.Dir(opts.GoModPath)
+	sub := filepath.Join(root, "sub")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeSubGoMod := func(module string) {
+		if err := os.WriteFile(filepath.Join(sub, "go.mod"), []byte("module "+module+"\n\ngo 1.21\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(t, opts, FindReplace{Find: "example.com/root/sub", Replace: sub})
+	opts.NoValidate = false
+	opts.Relative = true
+	// go itself must accept the directive
+	opts.VerifyList = true
+
+	writeSubGoMod("example.com/root/sub")
+	plan, err := NewPlan(opts)
+	if err != nil {
+		t.Fatalf("NewPlan: %v", err)
+	}
+	if len(plan.Warnings) != 0 {
+		t.Errorf("nested module warned: %q", plan.Warnings)
+	}
+	if err = Apply(plan); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	content, err := os.ReadFile(opts.GoModPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "replace example.com/root/sub => ./sub\n") {
+		t.Errorf("no relative replace of the submodule:\n%s", content)
+	}
+
+	// Validation reads the submodule's own go.mod, not the root's
+	writeSubGoMod("example.com/other")
+	plan, err = NewPlan(opts)
+	if err != nil {
+		t.Fatalf("NewPlan: %v", err)
+	}
+	if !slices.ContainsFunc(plan.Warnings, func(msg string) bool { return strings.Contains(msg, "example.com/other") }) {
+		t.Errorf("no warning for the submodule declaring another module: %q", plan.Warnings)
+	}
+}
+
+func TestNewPlansSharedConfig(t *testing.T) {
+	a := writeTestModule(t, testGoMod, `{"find":"example.com/thismodule","replace":"/tmp/this"}`)
+	b := writeTestModule(t, testGoMod, "")
+	config, err := ReadConfig(a.ConfigPath, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every plan gets the rules without reading the config again
+	if err = os.Remove(a.ConfigPath); err != nil {
+		t.Fatal(err)
+	}
+
+	a.Config = config
+	goModPaths := []string{a.GoModPath, b.GoModPath}
+	plans, errs, err := NewPlans(a, goModPaths, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, plan := range plans {
+		if errs[i] != nil {
+			t.Fatalf("NewPlan of %s: %v", goModPaths[i], errs[i])
+		}
+		if len(plan.Add) != 1 || plan.Add[0].Replace != "/tmp/this" {
+			t.Errorf("%s: plan adds %v, want the config's rule", plan.GoModPath, plan.Add)
+		}
+	}
+}
+
+func BenchmarkNewPlans(b *testing.B) {
+	// A synthetic tree of modules, each requiring every module a rule replaces
+	const modules, requires = 200, 50
+	dir := b.TempDir()
+	var config, require strings.Builder
+	for i := 0; i < requires; i++ {
+		fmt.Fprintf(&require, "\texample.com/dep%03d v1.0.0\n", i)
+		fmt.Fprintf(&config, "{\"find\":\"example.com/dep%03d\",\"replace\":\"../dep%03d\"}\n", i, i)
+	}
+	configPath := filepath.Join(dir, "config.jsonl")
+	if err := os.WriteFile(configPath, []byte(config.String()), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	goModPaths := make([]string, modules)
+	for i := range goModPaths {
+		goModPaths[i] = filepath.Join(dir, fmt.Sprintf("mod%d", i), "go.mod")
+		if err := os.Mkdir(filepath.Dir(goModPaths[i]), 0o755); err != nil {
+			b.Fatal(err)
+		}
+		goMod := fmt.Sprintf("module example.com/mod%d\n\ngo 1.21\n\nrequire (\n%s)\n", i, require.String())
+		if err := os.WriteFile(goModPaths[i], []byte(goMod), 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	opts := Options{ConfigPath: configPath, NoValidate: true}
+	for _, concurrency := range []int{1, 8} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, errs, err := NewPlans(opts, goModPaths, concurrency)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, err := range errs {
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+module example.com/mymodule
+
+go 1.21
+
+require example.com/thismodule v1.2.3
+
+exclude (
+	example.com/thismodule v1.3.0
+	example.com/thismodule v1.4.0
+)
+
+exclude example.com/thatmodule v1.0.0
+
+retract v1.0.0 // published by mistake
+
+retract [v1.1.0, v1.1.5]
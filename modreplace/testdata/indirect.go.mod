@@ -0,0 +1,12 @@
+module example.com/mymodule
+
+go 1.21
+
+require example.com/thismodule v1.2.3
+
+require (
+	example.com/indirectmodule v1.0.0 // indirect
+	example.com/thatmodule v1.2.3 // indirect
+)
+
+require example.com/thatmodule v1.2.3
@@ -0,0 +1,7 @@
+module example.com/mymodule
+
+go 1.21
+
+require example.com/thismodule v1.2.3
+
+module example.com/othermodule
@@ -0,0 +1,11 @@
+module example.com/mymodule
+
+go 1.21
+
+require ( // example.com/delimited is vendored
+	// example.com/commentedmodule is not required
+	example.com/required v1.0.0
+	example.com/paren v1.0.0 // (pinned with example.com/pinned)
+) // example.com/closing
+
+require example.com/single v1.0.0
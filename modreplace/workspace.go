@@ -0,0 +1,196 @@
+package modreplace
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/semver"
+)
+
+// workspaceModules returns the go.mod path of every module the go.work at
+// goWorkPath uses, in the order the use directives appear.
+func workspaceModules(goWorkPath string) ([]string, error) {
+	content, err := os.ReadFile(goWorkPath)
+	if err != nil {
+		return nil, err
+	}
+
+	work, err := modfile.ParseWork(goWorkPath, content, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use paths are relative to the go.work directory
+	dir := filepath.Dir(goWorkPath)
+
+	var goModPaths []string
+	for _, use := range work.Use {
+		path := use.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		goModPaths = append(goModPaths, filepath.Join(path, "go.mod"))
+	}
+
+	return goModPaths, nil
+}
+
+// LayeredModules returns the go.mod path of every module the go.work files
+// at goWorkPaths use, layered in order: a later file that uses a different
+// directory for a module an earlier one uses takes its place, and each such
+// override is reported. Every go.mod must exist and declare a module.
+func LayeredModules(goWorkPaths []string) ([]string, []string, error) {
+	var goModPaths, overrides []string
+	byModule := make(map[string]int)
+	from := make(map[string]string)
+	for _, goWorkPath := range goWorkPaths {
+		paths, err := workspaceModules(goWorkPath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, path := range paths {
+			modulePath, err := ReadModulePath(path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", goWorkPath, err)
+			}
+
+			i, ok := byModule[modulePath]
+			if !ok {
+				byModule[modulePath] = len(goModPaths)
+				goModPaths = append(goModPaths, path)
+			} else if filepath.Clean(goModPaths[i]) != filepath.Clean(path) {
+				overrides = append(overrides, fmt.Sprintf("%s: %s uses %s instead of %s from %s", modulePath, goWorkPath, filepath.Dir(path), filepath.Dir(goModPaths[i]), from[modulePath]))
+				goModPaths[i] = path
+			}
+			from[modulePath] = goWorkPath
+		}
+	}
+
+	return goModPaths, overrides, nil
+}
+
+// Migration is the go.work that replaces the local replaces of some modules,
+// and the modules whose local replaces it makes unnecessary.
+type Migration struct {
+	Work []byte
+	// Local maps each go.mod to the modules it replaces with a directory
+	Local map[string][]string
+}
+
+// MigrateToWorkspace builds a go.work at goWorkPath that uses every module in
+// goModPaths and every directory they replace a managed module with. A
+// replace is managed when goreplace wrote it or a rule in config finds it;
+// config may be nil.
+func MigrateToWorkspace(goWorkPath string, goModPaths []string, config *Config) (*Migration, error) {
+	managed := make(map[string]bool)
+	if config != nil {
+		for _, cmd := range config.Rules {
+			managed[ruleModule(cmd)] = true
+		}
+	}
+
+	workDir, err := filepath.Abs(filepath.Dir(goWorkPath))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Migration{Local: make(map[string][]string)}
+	work := &modfile.WorkFile{Syntax: &modfile.FileSyntax{}}
+	used := make(map[string]bool)
+	use := func(dir string) error {
+		rel, err := relativeTarget(workDir, dir)
+		if err != nil || used[rel] {
+			return err
+		}
+		used[rel] = true
+		return work.AddUse(rel, "")
+	}
+
+	for _, goModPath := range goModPaths {
+		content, err := os.ReadFile(goModPath)
+		if err != nil {
+			return nil, err
+		}
+		file, err := modfile.Parse(goModPath, content, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		// The workspace needs a go version at least as new as every module's
+		if file.Go != nil && (work.Go == nil || semver.Compare("v"+file.Go.Version, "v"+work.Go.Version) > 0) {
+			if err = work.AddGoStmt(file.Go.Version); err != nil {
+				return nil, err
+			}
+		}
+
+		moduleDir, err := filepath.Abs(filepath.Dir(goModPath))
+		if err != nil {
+			return nil, err
+		}
+		if err = use(moduleDir); err != nil {
+			return nil, err
+		}
+
+		for _, r := range file.Replace {
+			if !isLocalPath(r.New.Path) || !(managed[r.Old.Path] || hasProvenance(r.Syntax)) {
+				continue
+			}
+			if err = use(resolveTarget(moduleDir, r.New.Path)); err != nil {
+				return nil, err
+			}
+			m.Local[goModPath] = append(m.Local[goModPath], r.Old.Path)
+		}
+	}
+
+	// go.work files only exist from go 1.18 on
+	if work.Go == nil || semver.Compare("v"+work.Go.Version, "v1.18") < 0 {
+		if err = work.AddGoStmt("1.18"); err != nil {
+			return nil, err
+		}
+	}
+
+	m.Work = modfile.Format(work.Syntax)
+	return m, nil
+}
+
+// DropLocalReplaces removes the local replaces m makes unnecessary from the
+// go.mod at goModPath, keeping a .bak copy first when backup is set. It
+// returns how many replaces it removed.
+func (m *Migration) DropLocalReplaces(goModPath string, backup bool) (int, error) {
+	modules := m.Local[goModPath]
+	if len(modules) == 0 {
+		return 0, nil
+	}
+
+	content, err := os.ReadFile(goModPath)
+	if err != nil {
+		return 0, err
+	}
+	inScope := func(module string) bool { return slices.Contains(modules, module) }
+	updated, err := updateModReplace(content, nil, nil, inScope, false, "", "")
+	if err != nil {
+		return 0, err
+	}
+	w := writeOptions{ctx: context.Background(), backup: backup}
+	if err = w.write(goModPath, updated); err != nil {
+		return 0, err
+	}
+	return len(modules), nil
+}
+
+// hasProvenance reports whether a parsed directive carries the comment
+// goreplace adds to the replaces it writes.
+func hasProvenance(line *modfile.Line) bool {
+	for _, comment := range line.Comments.Suffix {
+		if strings.Contains(comment.Token, provenanceMarker) {
+			return true
+		}
+	}
+	return false
+}
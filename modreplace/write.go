@@ -0,0 +1,207 @@
+package modreplace
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// writeOptions control how modified files are written back.
+type writeOptions struct {
+	// ctx is checked before a file is replaced, so a cancelled run never
+	// commits a write
+	ctx      context.Context
+	backup   bool
+	noRename bool
+	// tempDir holds the temp files of atomic writes instead of the target's
+	// own directory
+	tempDir string
+	// keepTemp leaves the temp file of a failed atomic write behind
+	keepTemp bool
+	// warn, when set, is told when an atomic write falls back to rewriting
+	// the file in place
+	warn func(msg string)
+}
+
+// write replaces the file at filePath with content. Renaming a temp file over
+// the original is atomic, but on some network filesystems rename over an
+// existing file misbehaves, so noRename rewrites the file in place instead.
+func (w writeOptions) write(filePath string, content []byte) error {
+	// Write to the file a symlink points at, so the rename doesn't replace
+	// the link itself with a regular file
+	filePath, err := filepath.EvalSymlinks(filePath)
+	if err != nil {
+		return err
+	}
+
+	// Refuse read-only targets up front rather than failing mid-write
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0o200 == 0 {
+		return fmt.Errorf("%s is read-only (is it in the module cache?); use -dry-run or -check to inspect it", filePath)
+	}
+
+	if w.backup {
+		original, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filePath+".bak", original, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	if w.noRename {
+		return writeFileInPlace(w.ctx, filePath, content)
+	}
+	return w.writeAtomic(filePath, content)
+}
+
+// writeAtomic atomically replaces the file at filePath with content. The
+// original is left untouched if w.ctx is done before the rename. The temp
+// file is created in w.tempDir when set; if that is on another device the
+// rename can't work, so the file is rewritten in place instead and w.warn is
+// told. With w.keepTemp a failed write leaves the temp file behind and names
+// it in the error.
+func (w writeOptions) writeAtomic(filePath string, content []byte) (err error) {
+	ctx, tempDir, keepTemp := w.ctx, w.tempDir, w.keepTemp
+	dir := tempDir
+	if dir == "" {
+		dir = filepath.Dir(filePath)
+	}
+
+	// Create a temporary file
+	tempFile, err := os.CreateTemp(dir, filepath.Base(filePath)+".temp")
+	if err != nil {
+		if errors.Is(err, fs.ErrPermission) {
+			return fmt.Errorf("directory of %s is read-only; use -dry-run or -check to inspect it: %w", filePath, err)
+		}
+		return err
+	}
+	defer tempFile.Close()
+	defer func() {
+		// Cleanup in case of error, unless the evidence is wanted
+		if err != nil && keepTemp {
+			err = fmt.Errorf("%w (temp file kept at %s)", err, tempFile.Name())
+			return
+		}
+		os.Remove(tempFile.Name())
+	}()
+
+	// Write the new content to the temporary file
+	if _, err = tempFile.Write(content); err != nil {
+		return err
+	}
+
+	// Close the temporary file
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	// Renaming is the commit point, so give up here if the run was cancelled
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+
+	// Replace the original file with the temporary file
+	err = os.Rename(tempFile.Name(), filePath)
+	if tempDir != "" && errors.Is(err, syscall.EXDEV) {
+		if w.warn != nil {
+			w.warn(fmt.Sprintf("%s: temp dir %s is on another device, so the file was rewritten in place rather than atomically", filePath, tempDir))
+		}
+		return writeFileInPlace(ctx, filePath, content)
+	}
+	return err
+}
+
+// CheckTempDir reports whether temp files can be created in dir.
+func CheckTempDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("temp dir: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("temp dir %s is not a directory", dir)
+	}
+
+	f, err := os.CreateTemp(dir, "goreplace-check")
+	if err != nil {
+		return fmt.Errorf("temp dir %s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// writeFileInPlace truncates filePath and writes content to it. A failure
+// part way through leaves the file incomplete.
+func writeFileInPlace(ctx context.Context, filePath string, content []byte) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err = file.Write(content); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// tidyGoSum removes go.sum entries for modules that replace points at a local
+// directory. It returns the content it wrote over, even when the write failed
+// part way, or nil when it left go.sum alone. A missing go.sum is not an
+// error.
+func tidyGoSum(goSumPath string, replace []FindReplace, w writeOptions) ([]byte, error) {
+	original, err := os.ReadFile(goSumPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	local := make(map[string]bool)
+	for _, cmd := range replace {
+		if isLocalPath(cmd.Replace) {
+			local[cmd.Find] = true
+		}
+	}
+
+	var buf bytes.Buffer
+
+	// Each go.sum line is "module version hash"
+	scanner := bufio.NewScanner(bytes.NewReader(original))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) > 0 && local[fields[0]] {
+			continue
+		}
+		buf.WriteString(line + "\n")
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Leave go.sum alone if nothing was dropped
+	if bytes.Equal(original, buf.Bytes()) {
+		return nil, nil
+	}
+
+	return original, w.write(goSumPath, buf.Bytes())
+}
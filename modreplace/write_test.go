@@ -0,0 +1,98 @@
+package modreplace
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteCancelled(t *testing.T) {
+	cause := errors.New("timed out")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(cause)
+
+	for _, noRename := range []bool{false, true} {
+		filePath := filepath.Join(t.TempDir(), "go.mod")
+		if err := os.WriteFile(filePath, []byte("original\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		w := writeOptions{ctx: ctx, noRename: noRename}
+		if err := w.write(filePath, []byte("updated\n")); !errors.Is(err, cause) {
+			t.Errorf("noRename %v: write returned %v, want %v", noRename, err, cause)
+		}
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "original\n" {
+			t.Errorf("noRename %v: cancelled write left %q", noRename, content)
+		}
+	}
+}
+
+func TestWriteCrossDeviceWarns(t *testing.T) {
+	const tempDir = "/dev/shm"
+	if err := CheckTempDir(tempDir); err != nil {
+		t.Skip(err)
+	}
+	filePath := filepath.Join(t.TempDir(), "go.mod")
+	if err := os.WriteFile(filePath, []byte("original\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings []string
+	w := writeOptions{ctx: context.Background(), tempDir: tempDir, warn: func(msg string) { warnings = append(warnings, msg) }}
+	if err := w.write(filePath, []byte("updated\n")); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "updated\n" {
+		t.Errorf("write left %q", content)
+	}
+	// The rename only fails when the temp dir really is another filesystem
+	if len(warnings) == 0 {
+		t.Skip("temp dir is on the same device")
+	}
+	if len(warnings) != 1 {
+		t.Errorf("got warnings %q, want one", warnings)
+	}
+}
+
+func TestApplySymlinkedGoMod(t *testing.T) {
+	opts := writeTestModule(t, testGoMod, `{"find":"example.com/thismodule","replace":"/tmp/this"}`)
+	realPath := opts.GoModPath
+	link := filepath.Join(t.TempDir(), "go.mod")
+	if err := os.Symlink(realPath, link); err != nil {
+		t.Skip(err)
+	}
+	opts.GoModPath = link
+
+	plan, err := NewPlan(opts)
+	if err != nil {
+		t.Fatalf("NewPlan: %v", err)
+	}
+	if err = Apply(plan); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	info, err := os.Lstat(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Error("Apply replaced the symlink with a regular file")
+	}
+	content, err := os.ReadFile(realPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "replace example.com/thismodule => /tmp/this") {
+		t.Errorf("the file the symlink points at wasn't updated:\n%s", content)
+	}
+}
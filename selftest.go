@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"goreplace/modreplace"
+)
+
+// selftestGoMod and selftestConfig are the fixture selftest runs against; the
+// config's target is the local directory created next to go.mod.
+const selftestGoMod = `module example.com/selftest
+
+go 1.21
+
+require (
+	example.com/kept v1.0.0
+	example.com/local v1.2.3
+)
+
+replace example.com/stale => ../stale
+`
+
+const selftestConfig = `- find: example.com/local
+  replace: %s
+`
+
+// selftest runs the core pipeline over a fixture in a temp directory and
+// writes one OK or FAIL line per stage to w. It reports whether every stage
+// passed.
+func selftest(w io.Writer) bool {
+	// Rules from the environment would change what the fixture matches
+	os.Unsetenv(modreplace.RulesEnv)
+
+	dir, err := os.MkdirTemp("", "goreplace-selftest")
+	if err != nil {
+		fmt.Fprintf(w, "setup: FAIL: %v\n", err)
+		return false
+	}
+	defer os.RemoveAll(dir)
+
+	goModPath := filepath.Join(dir, "go.mod")
+	configPath := filepath.Join(dir, "replace.yaml")
+	local := filepath.Join(dir, "local")
+	for path, content := range map[string]string{goModPath: selftestGoMod, configPath: fmt.Sprintf(selftestConfig, local)} {
+		if err = os.WriteFile(path, []byte(content), 0o644); err != nil {
+			fmt.Fprintf(w, "setup: FAIL: %v\n", err)
+			return false
+		}
+	}
+	if err = os.Mkdir(local, 0o755); err != nil {
+		fmt.Fprintf(w, "setup: FAIL: %v\n", err)
+		return false
+	}
+
+	stages := []struct {
+		name string
+		run  func() error
+	}{
+		{"matching", func() error {
+			plan, err := modreplace.NewPlan(modreplace.Options{GoModPath: goModPath, ConfigPath: configPath})
+			if err != nil {
+				return err
+			}
+			if len(plan.Add) != 1 || plan.Add[0].Find != "example.com/local" {
+				return fmt.Errorf("matched %v, want example.com/local", plan.Add)
+			}
+			return nil
+		}},
+		{"cleaning", func() error {
+			plan, err := modreplace.NewPlan(modreplace.Options{GoModPath: goModPath, ConfigPath: configPath, Clean: true})
+			if err != nil {
+				return err
+			}
+			content, err := plan.Content()
+			if err != nil {
+				return err
+			}
+			if strings.Contains(string(content), "replace") {
+				return fmt.Errorf("replaces left after cleaning:\n%s", content)
+			}
+			return nil
+		}},
+		{"appending", func() error {
+			plan, err := modreplace.NewPlan(modreplace.Options{GoModPath: goModPath, ConfigPath: configPath})
+			if err != nil {
+				return err
+			}
+			if err = modreplace.Apply(plan); err != nil {
+				return err
+			}
+			content, err := os.ReadFile(goModPath)
+			if err != nil {
+				return err
+			}
+			want := fmt.Sprintf("replace example.com/local => %s // goreplace (from replace.yaml)\n", local)
+			if !strings.Contains(string(content), want) || strings.Contains(string(content), "example.com/stale") {
+				return fmt.Errorf("wrote:\n%s", content)
+			}
+			return nil
+		}},
+	}
+
+	ok := true
+	for _, stage := range stages {
+		if err := stage.run(); err != nil {
+			fmt.Fprintf(w, "%s: FAIL: %v\n", stage.name, err)
+			ok = false
+			continue
+		}
+		fmt.Fprintf(w, "%s: OK\n", stage.name)
+	}
+	return ok
+}